@@ -3,13 +3,17 @@ package client
 import (
 	"MapRelay/logging"
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
@@ -18,35 +22,101 @@ import (
 var logger = logging.Named("Client")
 
 type compileRequest struct {
-	VMF      string `json:"vmf"`
-	VMFName  string `json:"vmfName,omitempty"`
-	VMFData  []byte `json:"vmfData,omitempty"`
-	Preset   string `json:"preset"`
-	Password string `json:"password"`
+	Type      string `json:"type,omitempty"`
+	JobID     string `json:"jobId,omitempty"`
+	VMF       string `json:"vmf"`
+	VMFName   string `json:"vmfName,omitempty"`
+	VMFSize   int64  `json:"vmfSize,omitempty"`
+	VMFSha256 string `json:"vmfSha256,omitempty"`
+	Preset    string `json:"preset"`
+	// Compile with this revision of the preset instead of the current one.
+	PresetRevision int               `json:"presetRevision,omitempty"`
+	Profile        string            `json:"profile,omitempty"`
+	Params         map[string]string `json:"params,omitempty"`
+	User           string            `json:"user,omitempty"`
+	Token          string            `json:"token,omitempty"`
+	Password       string            `json:"password"`
 }
 
 type Preset struct {
-	Name  string `json:"name"`
-	Steps []struct {
+	Name    string   `json:"name"`
+	Extends string   `json:"extends,omitempty"`
+	Profile string   `json:"profile,omitempty"`
+	Params  []string `json:"params,omitempty"`
+	Steps   []struct {
 		Program string   `json:"program"`
 		Args    []string `json:"args"`
+		Mode    string   `json:"mode,omitempty"`
+
+		When            string `json:"when,omitempty"`
+		ContinueOnError bool   `json:"continueOnError,omitempty"`
+		Timeout         string `json:"timeout,omitempty"`
+		Retries         int    `json:"retries,omitempty"`
 	} `json:"steps"`
+	Revision        int       `json:"revision,omitempty"`
+	ExtendsRevision int       `json:"extendsRevision,omitempty"`
+	UpdatedBy       string    `json:"updatedBy,omitempty"`
+	UpdatedAt       time.Time `json:"updatedAt,omitzero"`
 }
 
 func RunClient(args []string) {
 	fs := flag.NewFlagSet("client", flag.ContinueOnError)
-	serverUrl := fs.String("server", "localhost:8000", "Server WS URL (host:port). Do not include protocol or trailing slash")
-	useHttp := fs.Bool("useHttp", false, "Use HTTP instead of HTTPS")
+	serverUrl := fs.String("server", "localhost:8000", "Server address (host:port) or URL including scheme and base path, e.g. https://tools.example/maprelay")
+	useHttp := fs.Bool("useHttp", false, "Use plain HTTP/WS instead of HTTPS/WSS when -server has no scheme")
+	fingerprint := fs.String("fingerprint", os.Getenv("MAPRELAY_FINGERPRINT"), "SHA-256 fingerprint of the server's TLS certificate to trust, e.g. a self-signed one (defaults to $MAPRELAY_FINGERPRINT)")
 	vmfPath := fs.String("vmf", "map.vmf", "VMF path")
 	preset := fs.String("preset", "default", "Preset name to use")
+	profile := fs.String("profile", "", "Game profile to compile for, overriding the preset's")
 	password := fs.String("password", "", "Server password, if configured")
+	token := fs.String("token", os.Getenv("MAPRELAY_TOKEN"), "Personal API token (defaults to $MAPRELAY_TOKEN)")
+	userName := fs.String("user", currentUser(), "Name recorded as the owner of compile jobs")
 	uploadPreset := fs.String("uploadPreset", "", "Path to a preset JSON file to upload/update on server")
+	attach := fs.String("attach", "", "Job ID to reattach to instead of starting a new compile")
+	cancel := fs.String("cancel", "", "Job ID to cancel")
+	download := fs.String("download", "", "Job ID whose BSP to download over HTTP, resuming a partial download")
+	params := paramFlag{}
+	fs.Var(params, "param", "Preset parameter as name=value, e.g. -param bounces=8 (repeatable)")
+	var presetCmd presetCommand
+	presetCmd.register(fs)
 
 	if err := fs.Parse(args); err != nil {
 		logger.Fatal("Failed to parse client flags", zap.Error(err))
 		return
 	}
 
+	creds := credentials{password: *password, token: *token}
+
+	if *fingerprint != "" {
+		if err := pinFingerprint(*fingerprint); err != nil {
+			logger.Fatal("Invalid -fingerprint", zap.Error(err))
+			return
+		}
+	}
+
+	baseUrl, wsUrl, err := serverEndpoints(*serverUrl, *useHttp)
+	if err != nil {
+		logger.Fatal("Invalid -server", zap.Error(err))
+		return
+	}
+
+	if *download != "" {
+		outPath, err := downloadArtifact(baseUrl, creds, *download, *vmfPath)
+		if err != nil {
+			logger.Fatal("Failed to download BSP", zap.Error(err))
+			return
+		}
+
+		logger.Info("Downloaded compiled BSP", zap.String("path", outPath))
+		return
+	}
+
+	if presetCmd.given() {
+		if err := presetCmd.run(baseUrl, creds); err != nil {
+			logger.Fatal("Preset command failed", zap.Error(err))
+		}
+		return
+	}
+
 	if *uploadPreset != "" {
 		b, err := os.ReadFile(*uploadPreset)
 		if err != nil {
@@ -54,12 +124,7 @@ func RunClient(args []string) {
 			return
 		}
 
-		scheme := "https://"
-		if *useHttp {
-			scheme = "http://"
-		}
-
-		apiUrl := scheme + *serverUrl + "/api/presets"
+		apiUrl := baseUrl + "/api/presets"
 		req, err := http.NewRequest(http.MethodPost, apiUrl, bytes.NewReader(b))
 		if err != nil {
 			logger.Fatal("Failed to create request", zap.Error(err))
@@ -67,9 +132,9 @@ func RunClient(args []string) {
 		}
 
 		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("X-Password", *password)
+		creds.apply(req)
 
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := httpClient.Do(req)
 		if err != nil {
 			logger.Fatal("Failed to upload preset", zap.Error(err))
 			return
@@ -88,8 +153,7 @@ func RunClient(args []string) {
 		return
 	}
 
-	wsUrl := "ws://" + *serverUrl
-	c, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	c, _, err := wsDialer.Dial(wsUrl, nil)
 	if err != nil {
 		logger.Fatal("Failed to connect to server", zap.Error(err))
 		return
@@ -97,19 +161,55 @@ func RunClient(args []string) {
 
 	defer c.Close()
 
-	logger.Info("Uploading VMF", zap.String("path", *vmfPath))
-	b, err := os.ReadFile(*vmfPath)
-	if err != nil {
-		logger.Fatal("Failed to read VMF", zap.Error(err))
-		return
-	}
-	req := compileRequest{VMF: *vmfPath, VMFName: filepath.Base(*vmfPath), VMFData: b, Preset: *preset, Password: *password}
-	payload, _ := json.Marshal(req)
-	if err := c.WriteMessage(websocket.TextMessage, payload); err != nil {
-		logger.Fatal("Failed to send VMF to server", zap.Error(err))
-		return
+	if *cancel != "" {
+		req := compileRequest{Type: "cancel", JobID: *cancel}
+		creds.fill(&req)
+		payload, _ := json.Marshal(req)
+		if err := c.WriteMessage(websocket.TextMessage, payload); err != nil {
+			logger.Fatal("Failed to cancel job", zap.Error(err))
+			return
+		}
+		logger.Info("Cancelling job", zap.String("job", *cancel))
+	} else if *attach != "" {
+		req := compileRequest{Type: "attach", JobID: *attach}
+		creds.fill(&req)
+		payload, _ := json.Marshal(req)
+		if err := c.WriteMessage(websocket.TextMessage, payload); err != nil {
+			logger.Fatal("Failed to attach to job", zap.Error(err))
+			return
+		}
+		logger.Info("Attaching to job", zap.String("job", *attach))
+	} else {
+		logger.Info("Uploading VMF", zap.String("path", *vmfPath))
+		req := compileRequest{VMF: *vmfPath, VMFName: filepath.Base(*vmfPath), Preset: *preset, PresetRevision: *presetCmd.revision, Profile: *profile, Params: params, User: *userName}
+		creds.fill(&req)
+		n, err := uploadVMF(c, req, *vmfPath)
+		if err != nil {
+			logger.Fatal("Failed to send VMF to server", zap.Error(err))
+			return
+		}
+		logger.Info("Uploaded VMF", zap.Int64("bytes", n))
 	}
-	logger.Info("Uploaded VMF", zap.Int("bytes", len(b)))
+
+	// Ctrl-C cancels the job on the server; a second Ctrl-C exits without waiting for it.
+	var jobID atomic.Value
+	jobID.Store(*attach)
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		id := jobID.Load().(string)
+		if id == "" {
+			os.Exit(1)
+		}
+
+		logger.Info("Cancelling job, press Ctrl-C again to quit immediately", zap.String("job", id))
+		payload, _ := json.Marshal(compileRequest{Type: "cancel", JobID: id})
+		_ = c.WriteMessage(websocket.TextMessage, payload)
+
+		<-interrupts
+		os.Exit(1)
+	}()
 
 	for {
 		_, msg, err := c.ReadMessage()
@@ -123,37 +223,22 @@ func RunClient(args []string) {
 			Type string `json:"type"`
 		}
 		if err := json.Unmarshal(msg, &mt); err == nil && mt.Type != "" {
-			// Handle BSP transfer specially
+			// Handle BSP transfer specially: a header followed by binary frames
 			if mt.Type == "bsp" {
-				var bm struct {
-					Type string `json:"type"`
-					Name string `json:"name"`
-					Data string `json:"data"`
-				}
-				if err := json.Unmarshal(msg, &bm); err == nil {
-					logger.Info("Downloading compiled BSP", zap.String("name", bm.Name))
-					decoded, derr := base64.StdEncoding.DecodeString(bm.Data)
-					if derr != nil {
-						logger.Error("Failed to decode BSP data", zap.Error(derr))
-						continue
-					}
-					outDir := filepath.Dir(*vmfPath)
-					outName := bm.Name
-					if outName == "" {
-						// derive from vmf name
-						base := filepath.Base(*vmfPath)
-						name := base
-						if dot := len(base) - len(filepath.Ext(base)); dot > 0 {
-							name = base[:dot]
+				var hdr bspHeader
+				if err := json.Unmarshal(msg, &hdr); err == nil {
+					outPath := bspOutPath(*vmfPath, hdr.Name)
+					logger.Info("Downloading compiled BSP", zap.String("name", hdr.Name), zap.Int64("bytes", hdr.Size))
+					if err := receiveBSP(c, hdr, outPath); err != nil {
+						logger.Error("Failed to download BSP", zap.Error(err), zap.String("path", outPath))
+						if errors.Is(err, errDownloadInterrupted) {
+							if id := jobID.Load().(string); id != "" {
+								logger.Info("Resume the download with -download " + id)
+							}
 						}
-						outName = name + ".bsp"
+						break
 					}
-					outPath := filepath.Join(outDir, outName)
-					if err := os.WriteFile(outPath, decoded, 0644); err != nil {
-						logger.Error("Failed to write BSP file", zap.Error(err), zap.String("path", outPath))
-						continue
-					}
-					logger.Info("Downloaded compiled BSP", zap.String("path", outPath), zap.Int("bytes", len(decoded)))
+					logger.Info("Downloaded compiled BSP", zap.String("path", outPath), zap.Int64("bytes", hdr.Size))
 					continue
 				}
 			}
@@ -163,11 +248,20 @@ func RunClient(args []string) {
 				Message string `json:"message"`
 			}
 			if err := json.Unmarshal(msg, &m); err == nil {
+				if m.Type == "job" {
+					jobID.Store(m.Message)
+					logger.Info("Compile job started; if the connection drops, reattach with -attach "+m.Message, zap.String("job", m.Message))
+					continue
+				}
 				logger.Info("Received", zap.String("type", m.Type), zap.String("message", m.Message))
 				if m.Type == "done" {
 					logger.Info("Compilation done")
 					break
 				}
+				if m.Type == "cancelled" {
+					logger.Info("Compilation cancelled")
+					break
+				}
 				continue
 			}
 		}
@@ -182,3 +276,11 @@ func RunClient(args []string) {
 	}
 	logger.Info("Client finished")
 }
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return ""
+}
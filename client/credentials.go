@@ -0,0 +1,25 @@
+package client
+
+import "net/http"
+
+// credentials authenticate the client against the server: a personal API token, or the shared
+// password on servers that have no accounts yet.
+type credentials struct {
+	password string
+	token    string
+}
+
+func (c credentials) apply(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.password != "" {
+		req.Header.Set("X-Password", c.password)
+	}
+}
+
+// fill copies the credentials into a socket request.
+func (c credentials) fill(req *compileRequest) {
+	req.Password = c.password
+	req.Token = c.token
+}
@@ -0,0 +1,269 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// errDownloadInterrupted marks a transfer that stopped part-way. The .part file is kept so the
+// download can be resumed over HTTP.
+var errDownloadInterrupted = errors.New("download interrupted")
+
+// bspHeader announces a BSP transfer; Size bytes of binary frames follow it.
+type bspHeader struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// bspOutPath picks where a downloaded BSP goes: next to the VMF, using the server's file name
+// or, failing that, the VMF's name with a .bsp extension.
+func bspOutPath(vmfPath, name string) string {
+	outDir := filepath.Dir(vmfPath)
+	if name == "" {
+		base := filepath.Base(vmfPath)
+		name = base
+		if dot := len(base) - len(filepath.Ext(base)); dot > 0 {
+			name = base[:dot]
+		}
+		name += ".bsp"
+	}
+
+	return filepath.Join(outDir, filepath.Base(name))
+}
+
+// receiveBSP reads the binary frames announced by hdr into a temporary file next to outPath,
+// verifies the checksum and only then replaces outPath, so a failed transfer never leaves a
+// truncated BSP behind.
+func receiveBSP(c *websocket.Conn, hdr bspHeader, outPath string) (err error) {
+	part := outPath + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+		if err != nil && !errors.Is(err, errDownloadInterrupted) {
+			_ = os.Remove(part)
+		}
+	}()
+
+	h := sha256.New()
+	p := newProgress("Downloading BSP", hdr.Size)
+	for p.done < hdr.Size {
+		mt, data, err := c.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("%w after %d of %d bytes: %w", errDownloadInterrupted, p.done, hdr.Size, err)
+		}
+
+		if mt != websocket.BinaryMessage {
+			return fmt.Errorf("%w: %s", errDownloadInterrupted, data)
+		}
+
+		if p.done+int64(len(data)) > hdr.Size {
+			return fmt.Errorf("server sent more than the declared %d bytes", hdr.Size)
+		}
+
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+
+		h.Write(data)
+		p.add(len(data))
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != hdr.SHA256 {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", hdr.SHA256, got)
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(part, outPath)
+}
+
+// downloadArtifact fetches a finished job's BSP from the artifacts endpoint, resuming from a
+// leftover .part file with a Range request when there is one. It returns the BSP's path.
+func downloadArtifact(baseUrl string, creds credentials, jobID, vmfPath string) (string, error) {
+	var rec struct {
+		State          string `json:"state"`
+		ArtifactPath   string `json:"artifactPath"`
+		ArtifactSHA256 string `json:"artifactSha256"`
+	}
+	if err := getJSON(baseUrl+"/api/jobs/"+url.PathEscape(jobID), creds, &rec); err != nil {
+		return "", err
+	}
+
+	if rec.ArtifactPath == "" {
+		return "", fmt.Errorf("job has no artifact (state: %s)", rec.State)
+	}
+
+	// The server may run on Windows, so normalise separators before taking the base name.
+	name := path.Base(strings.ReplaceAll(rec.ArtifactPath, "\\", "/"))
+	outPath := bspOutPath(vmfPath, name)
+	part := outPath + ".part"
+
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, baseUrl+"/api/jobs/"+url.PathEscape(jobID)+"/artifacts/"+url.PathEscape(name), nil)
+	if err != nil {
+		return "", err
+	}
+
+	creds.apply(req)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+		logger.Info("Resuming download", zap.String("path", part), zap.Int64("offset", offset))
+	case http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is already complete; just verify it below.
+		flags |= os.O_APPEND
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	p := newProgress("Downloading BSP", offset+resp.ContentLength)
+	p.resume(offset)
+	_, err = io.Copy(f, io.TeeReader(resp.Body, progressWriter{p}))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errDownloadInterrupted, err)
+	}
+
+	if sum, err := hashFileHex(part); err != nil {
+		return "", err
+	} else if sum != rec.ArtifactSHA256 {
+		_ = os.Remove(part)
+		return "", fmt.Errorf("checksum mismatch: expected %s, got %s", rec.ArtifactSHA256, sum)
+	}
+
+	return outPath, os.Rename(part, outPath)
+}
+
+// progressWriter feeds bytes passing through an io.TeeReader into a progress logger.
+type progressWriter struct {
+	p *progress
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	w.p.add(len(b))
+	return len(b), nil
+}
+
+func hashFileHex(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getJSON performs an authenticated GET and decodes the JSON response into v.
+func getJSON(u string, creds credentials, v any) error {
+	return doJSON(http.MethodGet, u, creds, nil, v)
+}
+
+// doJSON sends an authenticated request with body encoded as JSON (if not nil) and decodes a
+// successful response into v (if not nil).
+func doJSON(method, u string, creds credentials, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	creds.apply(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// paramFlag collects repeated -param name=value flags.
+type paramFlag map[string]string
+
+func (p paramFlag) String() string {
+	parts := make([]string, 0, len(p))
+	for k, v := range p {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+
+	return strings.Join(parts, ",")
+}
+
+func (p paramFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return errors.New("expected name=value")
+	}
+
+	p[strings.TrimPrefix(name, "$")] = value
+	return nil
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// presetCommand holds the preset management flags. At most one of them is expected per run.
+type presetCommand struct {
+	list    *bool
+	get     *string
+	remove  *string
+	rename  *string
+	newName *string
+	history *string
+	restore *string
+	asJSON  *bool
+	resolve *bool
+
+	// Also pins the revision used for compiles.
+	revision *int
+}
+
+// presetRevision is one entry of a preset's history.
+type presetRevision struct {
+	Preset
+	Action string `json:"action"`
+	Note   string `json:"note,omitempty"`
+}
+
+func (c *presetCommand) register(fs *flag.FlagSet) {
+	c.list = fs.Bool("listPresets", false, "List presets on the server")
+	c.get = fs.String("getPreset", "", "Print the named preset")
+	c.remove = fs.String("deletePreset", "", "Delete the named preset")
+	c.rename = fs.String("renamePreset", "", "Rename the named preset to -newName")
+	c.newName = fs.String("newName", "", "New name for -renamePreset")
+	c.history = fs.String("presetHistory", "", "List all revisions of the named preset")
+	c.restore = fs.String("rollbackPreset", "", "Restore the named preset to -presetRevision")
+	c.revision = fs.Int("presetRevision", 0, "Preset revision to compile with, or to restore with -rollbackPreset")
+	c.asJSON = fs.Bool("json", false, "Print presets as JSON instead of a table")
+	c.resolve = fs.Bool("resolved", false, "With -getPreset, show the steps after applying extends")
+}
+
+func (c *presetCommand) given() bool {
+	return *c.list || *c.get != "" || *c.remove != "" || *c.rename != "" || *c.history != "" || *c.restore != ""
+}
+
+func (c *presetCommand) run(baseUrl string, creds credentials) error {
+	presetUrl := func(name string) string {
+		return baseUrl + "/api/presets/" + url.PathEscape(name)
+	}
+
+	switch {
+	case *c.list:
+		var arr []Preset
+		if err := getJSON(baseUrl+"/api/presets", creds, &arr); err != nil {
+			return err
+		}
+
+		if *c.asJSON {
+			return printJSON(arr)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PRESET\tREV\tSTEPS\tUPDATED BY\tUPDATED")
+		for _, p := range arr {
+			programs := make([]string, len(p.Steps))
+			for i, s := range p.Steps {
+				programs[i] = s.Program
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", p.Name, p.Revision, strings.Join(programs, " → "), p.UpdatedBy, formatTime(p.UpdatedAt))
+		}
+		return tw.Flush()
+
+	case *c.get != "":
+		u := presetUrl(*c.get)
+		if *c.resolve {
+			u += "?resolved=true"
+		}
+
+		var p Preset
+		if err := getJSON(u, creds, &p); err != nil {
+			return err
+		}
+
+		if *c.asJSON {
+			return printJSON(p)
+		}
+
+		fmt.Println("Preset:  ", p.Name)
+		fmt.Println("Revision:", p.Revision)
+		if p.Extends != "" {
+			fmt.Printf("Extends:  %s (revision %d)\n", p.Extends, p.ExtendsRevision)
+		}
+		if p.Profile != "" {
+			fmt.Println("Profile: ", p.Profile)
+		}
+		if len(p.Params) > 0 {
+			fmt.Println("Params:  ", strings.Join(p.Params, " "))
+		}
+		if p.UpdatedBy != "" || !p.UpdatedAt.IsZero() {
+			fmt.Println("Updated: ", formatTime(p.UpdatedAt), "by", p.UpdatedBy)
+		}
+		for i, s := range p.Steps {
+			var notes []string
+			if s.Mode != "" {
+				notes = append(notes, s.Mode)
+			}
+			if s.When != "" {
+				notes = append(notes, "when "+s.When)
+			}
+			if s.ContinueOnError {
+				notes = append(notes, "continue on error")
+			}
+			if s.Timeout != "" {
+				notes = append(notes, "timeout "+s.Timeout)
+			}
+			if s.Retries > 0 {
+				notes = append(notes, fmt.Sprintf("retries %d", s.Retries))
+			}
+
+			extra := ""
+			if len(notes) > 0 {
+				extra = " (" + strings.Join(notes, ", ") + ")"
+			}
+			fmt.Printf("%d. %s%s %s\n", i+1, s.Program, extra, strings.Join(s.Args, " "))
+		}
+		return nil
+
+	case *c.remove != "":
+		if err := doJSON(http.MethodDelete, presetUrl(*c.remove), creds, nil, nil); err != nil {
+			return err
+		}
+
+		logger.Info("Preset deleted: " + *c.remove)
+		return nil
+
+	case *c.rename != "":
+		if *c.newName == "" {
+			return fmt.Errorf("-renamePreset needs -newName")
+		}
+
+		body := map[string]string{"name": *c.newName}
+		if err := doJSON(http.MethodPatch, presetUrl(*c.rename), creds, body, nil); err != nil {
+			return err
+		}
+
+		logger.Info("Preset renamed: " + *c.rename + " → " + *c.newName)
+		return nil
+
+	case *c.history != "":
+		var arr []presetRevision
+		if err := getJSON(presetUrl(*c.history)+"/history", creds, &arr); err != nil {
+			return err
+		}
+
+		if *c.asJSON {
+			return printJSON(arr)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "REV\tACTION\tBY\tWHEN\tNOTE")
+		for _, r := range arr {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", r.Revision, r.Action, r.UpdatedBy, formatTime(r.UpdatedAt), r.Note)
+		}
+		return tw.Flush()
+
+	case *c.restore != "":
+		if *c.revision <= 0 {
+			return fmt.Errorf("-rollbackPreset needs -presetRevision")
+		}
+
+		var p Preset
+		body := map[string]int{"revision": *c.revision}
+		if err := doJSON(http.MethodPost, presetUrl(*c.restore)+"/rollback", creds, body, &p); err != nil {
+			return err
+		}
+
+		logger.Info(fmt.Sprintf("Preset %s rolled back to revision %d as revision %d", p.Name, *c.revision, p.Revision))
+		return nil
+	}
+
+	return nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Local().Format("2006-01-02 15:04")
+}
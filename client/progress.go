@@ -0,0 +1,37 @@
+package client
+
+import (
+	"go.uber.org/zap"
+)
+
+// progress logs transfer progress in 10% steps so large uploads and downloads don't look hung.
+type progress struct {
+	what  string
+	total int64
+	done  int64
+	step  int64 // last 10% step that was logged
+}
+
+func newProgress(what string, total int64) *progress {
+	return &progress{what: what, total: total}
+}
+
+// resume starts counting from offset bytes, e.g. for a resumed download.
+func (p *progress) resume(offset int64) {
+	p.done = offset
+	if p.total > 0 {
+		p.step = offset * 10 / p.total
+	}
+}
+
+func (p *progress) add(n int) {
+	p.done += int64(n)
+	if p.total <= 0 {
+		return
+	}
+
+	if step := p.done * 10 / p.total; step > p.step {
+		p.step = step
+		logger.Info(p.what, zap.Int64("bytes", p.done), zap.Int64("total", p.total), zap.Int64("percent", step*10))
+	}
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gorilla/websocket"
+)
+
+// Size of each binary frame when streaming a VMF. Must stay below the server's frame limit.
+const uploadChunkSize = 1 << 20
+
+// uploadVMF sends req declaring the VMF's size and SHA-256, waits for the server to accept the
+// request and then streams the file in binary frames.
+func uploadVMF(c *websocket.Conn, req compileRequest, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if info.Size() == 0 {
+		return 0, errors.New("VMF is empty")
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	req.VMFSize = info.Size()
+	req.VMFSha256 = hex.EncodeToString(h.Sum(nil))
+
+	payload, _ := json.Marshal(req)
+	if err := c.WriteMessage(websocket.TextMessage, payload); err != nil {
+		return 0, err
+	}
+
+	// The server validates the request first and only then asks for the data.
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		return 0, err
+	}
+
+	var m struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(msg, &m) != nil || m.Type != "upload_ready" {
+		return 0, fmt.Errorf("server refused upload: %s", msg)
+	}
+
+	p := newProgress("Uploading VMF", req.VMFSize)
+	buf := make([]byte, uploadChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if werr := c.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+				return p.done, werr
+			}
+			p.add(n)
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return p.done, err
+		}
+	}
+
+	return p.done, nil
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// serverEndpoints turns the -server value into the base URL for the HTTP API and the URL of
+// the WebSocket endpoint. raw is either host:port, where useHttp picks plain HTTP over HTTPS,
+// or a full URL such as https://tools.example/maprelay whose path is kept as a prefix.
+func serverEndpoints(raw string, useHttp bool) (string, string, error) {
+	if !strings.Contains(raw, "://") {
+		scheme := "https://"
+		if useHttp {
+			scheme = "http://"
+		}
+		raw = scheme + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Host == "" {
+		return "", "", errors.New("server URL has no host")
+	}
+
+	secure := false
+	switch u.Scheme {
+	case "https", "wss":
+		secure = true
+	case "http", "ws":
+	default:
+		return "", "", errors.New("unsupported server URL scheme: " + u.Scheme)
+	}
+
+	if secure && useHttp {
+		return "", "", errors.New("-useHttp conflicts with " + u.Scheme + ":// in -server")
+	}
+
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	httpUrl, wsUrl := *u, *u
+	if secure {
+		httpUrl.Scheme, wsUrl.Scheme = "https", "wss"
+	} else {
+		httpUrl.Scheme, wsUrl.Scheme = "http", "ws"
+	}
+	wsUrl.Path += "/"
+
+	return httpUrl.String(), wsUrl.String(), nil
+}
@@ -2,9 +2,9 @@ module MapRelay
 
 go 1.25
 
-require go.uber.org/zap v1.27.0
-
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	go.uber.org/multierr v1.11.0 // indirect
+	github.com/gorilla/websocket v1.5.3
+	go.uber.org/zap v1.27.0
 )
+
+require go.uber.org/multierr v1.11.0 // indirect
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// handleUsers lists (GET) or creates (POST {"name": ..., "role": ...}) user accounts. New
+// accounts are mappers unless a role is given.
+func handleUsers(w http.ResponseWriter, r *http.Request) {
+	p, ok := requireRole(w, r, roleServerAdmin)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		arr, err := users.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(arr)
+	case http.MethodPost:
+		var body struct {
+			Name string `json:"name"`
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		if body.Role == "" {
+			body.Role = roleMapper
+		}
+
+		u, err := users.create(body.Name, body.Role)
+		if err != nil {
+			http.Error(w, err.Error(), statusForUserError(err))
+			return
+		}
+
+		logger.Info("User created", zap.String("user", u.Name), zap.String("role", u.Role), zap.String("by", p.Name))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(u)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleUser changes a user's role (PATCH {"role": ...}) or deletes the account along with
+// all of its tokens (DELETE).
+func handleUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPatch {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := requireRole(w, r, roleServerAdmin)
+	if !ok {
+		return
+	}
+
+	name := r.PathValue("name")
+	if r.Method == http.MethodPatch {
+		var body struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		if err := users.setRole(name, body.Role); err != nil {
+			http.Error(w, err.Error(), statusForUserError(err))
+			return
+		}
+
+		logger.Info("User role changed", zap.String("user", name), zap.String("role", body.Role), zap.String("by", p.Name))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := users.remove(name); err != nil {
+		http.Error(w, err.Error(), statusForUserError(err))
+		return
+	}
+
+	logger.Info("User deleted", zap.String("user", name), zap.String("by", p.Name))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCreateToken issues a new API token for a user. The plaintext token is only ever
+// returned in this response.
+func handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := requireRole(w, r, roleServerAdmin)
+	if !ok {
+		return
+	}
+
+	name := r.PathValue("name")
+	id, token, err := users.issueToken(name)
+	if err != nil {
+		http.Error(w, err.Error(), statusForUserError(err))
+		return
+	}
+
+	logger.Info("Token issued", zap.String("user", name), zap.String("token", id), zap.String("by", p.Name))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]string{"id": id, "user": name, "token": token})
+}
+
+func handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := requireRole(w, r, roleServerAdmin)
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := users.revokeToken(id); err != nil {
+		http.Error(w, err.Error(), statusForUserError(err))
+		return
+	}
+
+	logger.Info("Token revoked", zap.String("token", id), zap.String("by", p.Name))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func statusForUserError(err error) int {
+	switch {
+	case errors.Is(err, errUserNotFound), errors.Is(err, errTokenUnknown):
+		return http.StatusNotFound
+	case errors.Is(err, errUserExists):
+		return http.StatusConflict
+	}
+
+	return http.StatusBadRequest
+}
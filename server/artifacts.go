@@ -0,0 +1,141 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Compiled artifacts live under <dataDir>/artifacts/<jobID>/ so they outlive the job's
+// workspace and can be downloaded (and resumed) over HTTP until ArtifactRetention expires.
+
+func artifactDir(id string) string {
+	return filepath.Join(currentConfig().dataDir(), "artifacts", id)
+}
+
+// storeArtifact adds a file from the job's output dir to its artifact dir. It is hard-linked
+// where possible, so a kept workspace still has its output without a second copy on disk. It
+// returns the stored path and its SHA-256.
+func storeArtifact(j *job, src string) (string, string, error) {
+	dir := artifactDir(j.id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+
+	dst := filepath.Join(dir, filepath.Base(src))
+	if err := os.Link(src, dst); err != nil {
+		if err := copyFile(src, dst); err != nil {
+			return "", "", err
+		}
+	}
+
+	sum, err := hashFile(dst)
+	if err != nil {
+		return "", "", err
+	}
+
+	return dst, sum, nil
+}
+
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func removeArtifacts(id string) {
+	_ = os.RemoveAll(artifactDir(id))
+}
+
+// pruneArtifacts removes artifact dirs older than the configured retention.
+func pruneArtifacts() {
+	retention := currentConfig().artifactRetention()
+	if retention == 0 {
+		return
+	}
+
+	root := filepath.Join(currentConfig().dataDir(), "artifacts")
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-retention)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !e.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		removeArtifacts(e.Name())
+		logger.Info("Removed expired artifacts", zap.String("job", e.Name()))
+	}
+}
+
+// handleGetArtifact serves a stored artifact. http.ServeContent takes care of Range and
+// If-Range, so interrupted downloads can be resumed.
+func handleGetArtifact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := requireRole(w, r, roleViewer); !ok {
+		return
+	}
+
+	rec, ok := lookupJobRecord(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	name := r.PathValue("name")
+	if rec.ArtifactPath == "" || filepath.Base(rec.ArtifactPath) != name {
+		http.Error(w, "artifact not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(rec.ArtifactPath)
+	if err != nil {
+		http.Error(w, "artifact expired", http.StatusNotFound)
+		return
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "artifact not available", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if rec.ArtifactSHA256 != "" {
+		w.Header().Set("X-Checksum-Sha256", rec.ArtifactSHA256)
+	}
+
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
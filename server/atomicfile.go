@@ -0,0 +1,83 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeFileAtomic replaces path with data so that a crash leaves either the old or the new
+// contents, never a truncated file: it writes a temp file in the same directory, syncs it and
+// renames it over path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	ok := false
+	defer func() {
+		if !ok {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	ok = true
+
+	// Make the rename itself durable. Not every platform can sync a directory.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// rotateBackups shifts path.bak.1 … path.bak.n-1 up by one and copies the current file to
+// path.bak.1. A missing file is not an error.
+func rotateBackups(path string, n int) error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+
+	backup := func(i int) string {
+		return path + ".bak." + strconv.Itoa(i)
+	}
+
+	for i := n - 1; i >= 1; i-- {
+		if _, err := os.Stat(backup(i)); err == nil {
+			if err := os.Rename(backup(i), backup(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(backup(1), b, 0644)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// principal is the authenticated caller of an API request or compile socket.
+type principal struct {
+	Name string
+	Role string
+}
+
+// Name used for callers authenticated by the shared password (or an open server) rather
+// than a personal token.
+const sharedUser = "shared"
+
+var errUnauthorized = errors.New("unauthorized")
+
+// authenticate resolves credentials presented from ip to a principal, refusing clients that
+// are locked out after too many failures.
+func authenticate(ip, token, password string) (principal, error) {
+	if _, err := lockouts.check(ip); err != nil {
+		return principal{}, err
+	}
+
+	p, err := checkCredentials(token, password)
+	if err != nil {
+		lockouts.fail(ip)
+		return principal{}, err
+	}
+
+	lockouts.succeed(ip)
+	return p, nil
+}
+
+// checkCredentials resolves credentials to a principal. A personal API token identifies its
+// user. Until a server-admin has a token the shared Config.Password still works, as a
+// server-admin, and a server without a password stays open; after that only tokens are accepted.
+func checkCredentials(token, password string) (principal, error) {
+	if token != "" {
+		u, ok := users.lookupToken(token)
+		if !ok {
+			return principal{}, errUnauthorized
+		}
+
+		return principal{Name: u.Name, Role: u.Role}, nil
+	}
+
+	if users.hasAdminToken() {
+		return principal{}, errUnauthorized
+	}
+
+	if err := CheckPassword(password); err != nil {
+		return principal{}, err
+	}
+
+	return principal{Name: sharedUser, Role: roleServerAdmin}, nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+
+	return ""
+}
+
+func authenticateRequest(r *http.Request) (principal, error) {
+	return authenticate(clientIP(r), bearerToken(r), r.Header.Get("X-Password"))
+}
+
+// requireRole authenticates the request and checks the caller has at least the given role,
+// answering 401 or 403 itself when it returns false.
+func requireRole(w http.ResponseWriter, r *http.Request, role string) (principal, bool) {
+	p, err := authenticateRequest(r)
+	if errors.Is(err, errLockedOut) {
+		left, _ := lockouts.check(clientIP(r))
+		w.Header().Set("Retry-After", retryAfter(left))
+		http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+		return principal{}, false
+	}
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return principal{}, false
+	}
+
+	if !p.can(role) {
+		http.Error(w, "forbidden: requires "+role+" role", http.StatusForbidden)
+		return principal{}, false
+	}
+
+	return p, true
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Outcomes of a single config check.
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// wineCheckTimeout bounds `wine --version`, which can be slow the first time a prefix is set up.
+const wineCheckTimeout = 30 * time.Second
+
+type checkResult struct {
+	Check  string `json:"check"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// checkConfig verifies that the config describes a usable compile environment: programs
+// resolve to files, the game directory looks like one, Wine runs if it's needed and the
+// directories the server writes to are writable. Each game profile is checked the same way.
+func checkConfig(c Config) []checkResult {
+	var results []checkResult
+	add := func(check, status, detail string) {
+		results = append(results, checkResult{Check: check, Status: status, Detail: detail})
+	}
+
+	if len(c.Programs) == 0 && len(c.Profiles) == 0 {
+		add("programs", checkWarn, "no programs configured, presets can't have any steps")
+	}
+
+	// The top-level game settings are used by presets without a profile, unless there is a
+	// default one.
+	if c.DefaultProfile == "" {
+		results = append(results, checkGame(c, "")...)
+	} else if _, ok := c.Profiles[c.DefaultProfile]; !ok {
+		add("defaultProfile", checkFail, "no such profile: "+c.DefaultProfile)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Profiles)) {
+		pc, _ := c.forProfile(name)
+		if pc.BaseGamePath == "" {
+			add("profiles."+name+".baseGamePath", checkFail, "not set")
+		}
+		results = append(results, checkGame(pc, "profiles."+name+".")...)
+	}
+
+	add(writableCheck("workspaceRoot", c.workspaceRoot()))
+	add(writableCheck("dataDir", c.dataDir()))
+	if c.BspDir != "" {
+		add(writableCheck("bspdir", c.BspDir))
+	}
+
+	switch c.WorkspaceCleanup {
+	case "", cleanupAlways, cleanupOnSuccess, cleanupNever:
+	default:
+		add("workspaceCleanup", checkFail, "must be always, onSuccess or never: "+c.WorkspaceCleanup)
+	}
+
+	for name, value := range map[string]string{"historyMaxAge": c.HistoryMaxAge, "artifactRetention": c.ArtifactRetention, "workspaceRetention": c.WorkspaceRetention} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			add(name, checkFail, "not a duration: "+value)
+		}
+	}
+
+	for _, proxy := range c.TrustedProxies {
+		if _, err := parseProxy(proxy); err != nil {
+			add("trustedProxies", checkFail, "not an IP or CIDR: "+proxy)
+		}
+	}
+
+	if cert, key, err := c.tlsFiles(); err != nil {
+		add("tls", checkFail, err.Error())
+	} else if cert != "" {
+		_, certErr := os.Stat(cert)
+		switch {
+		case c.TLSSelfSigned && selfSignedMissing(cert, key) != nil:
+			add("tls", checkFail, selfSignedMissing(cert, key).Error())
+		case c.TLSSelfSigned && errors.Is(certErr, fs.ErrNotExist):
+			add("tls", checkOK, "self-signed certificate will be generated at "+cert)
+		default:
+			if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+				add("tls", checkFail, err.Error())
+			} else {
+				add("tls", checkOK, cert)
+			}
+		}
+	}
+
+	return results
+}
+
+// checkGame checks the game install described by c, naming each check with prefix.
+func checkGame(c Config, prefix string) []checkResult {
+	var results []checkResult
+	add := func(check, status, detail string) {
+		results = append(results, checkResult{Check: prefix + check, Status: status, Detail: detail})
+	}
+
+	if c.BaseGamePath != "" {
+		if info, err := os.Stat(c.BaseGamePath); err != nil || !info.IsDir() {
+			add("baseGamePath", checkFail, "not a directory: "+c.BaseGamePath)
+		} else {
+			add("baseGamePath", checkOK, c.BaseGamePath)
+		}
+	}
+
+	needsWine := false
+	for _, name := range slices.Sorted(maps.Keys(c.Programs)) {
+		path := resolveProgramPath(c, c.Programs[name])
+		isExe := strings.HasSuffix(strings.ToLower(path), ".exe")
+		needsWine = needsWine || (isExe && runtime.GOOS == "linux")
+
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+			add("programs."+name, checkFail, "not found: "+path)
+		case info.IsDir():
+			add("programs."+name, checkFail, "is a directory: "+path)
+		case !isExe && runtime.GOOS != "windows" && info.Mode()&0111 == 0:
+			add("programs."+name, checkFail, "not executable: "+path)
+		default:
+			add("programs."+name, checkOK, path)
+		}
+	}
+
+	if gameDir := c.gameDir(); gameDir == "" {
+		add("gamedir", checkWarn, "not set, $gamedir will be empty")
+	} else if _, err := os.Stat(filepath.Join(gameDir, "gameinfo.txt")); err != nil {
+		add("gamedir", checkFail, "no gameinfo.txt in "+gameDir)
+	} else {
+		add("gamedir", checkOK, gameDir)
+	}
+
+	if needsWine {
+		wine := c.WinePath
+		if wine == "" {
+			wine = "wine"
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), wineCheckTimeout)
+		out, err := exec.CommandContext(ctx, wine, "--version").Output()
+		cancel()
+		if err != nil {
+			add("wine", checkFail, wine+" --version failed: "+err.Error())
+		} else {
+			add("wine", checkOK, strings.TrimSpace(string(out)))
+		}
+	}
+
+	return results
+}
+
+// writableCheck reports whether the server could write to dir, without touching the disk. A
+// missing dir is fine as long as its nearest existing parent is writable, since the server
+// creates it when needed.
+func writableCheck(name, dir string) (string, string, string) {
+	info, err := os.Stat(dir)
+	switch {
+	case err == nil && !info.IsDir():
+		return name, checkFail, "not a directory: " + dir
+	case err == nil:
+		if err := dirWritable(dir); err != nil {
+			return name, checkFail, "not writable: " + err.Error()
+		}
+		return name, checkOK, dir
+	case !errors.Is(err, fs.ErrNotExist):
+		return name, checkFail, err.Error()
+	}
+
+	parent := dir
+	for {
+		next := filepath.Dir(parent)
+		if next == parent {
+			return name, checkFail, "no existing parent directory: " + dir
+		}
+		parent = next
+
+		info, err := os.Stat(parent)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return name, checkFail, err.Error()
+		}
+		if !info.IsDir() {
+			return name, checkFail, "not a directory: " + parent
+		}
+		break
+	}
+
+	if err := dirWritable(parent); err != nil {
+		return name, checkFail, "can't be created, " + parent + " is not writable: " + err.Error()
+	}
+
+	return name, checkOK, "would be created: " + dir
+}
+
+func checksFailed(results []checkResult) bool {
+	return slices.ContainsFunc(results, func(r checkResult) bool {
+		return r.Status == checkFail
+	})
+}
+
+func printCheckReport(w io.Writer, results []checkResult, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", strings.ToUpper(r.Status), r.Check, r.Detail)
+	}
+
+	return tw.Flush()
+}
+
+// logCheckReport logs problems found at startup. The server still starts, since a broken
+// program only affects presets that use it.
+func logCheckReport(results []checkResult) {
+	problems := 0
+	for _, r := range results {
+		switch r.Status {
+		case checkWarn:
+			problems++
+			logger.Warn("Config check: "+r.Check, zap.String("detail", r.Detail))
+		case checkFail:
+			problems++
+			logger.Error("Config check failed: "+r.Check, zap.String("detail", r.Detail))
+		}
+	}
+
+	if problems == 0 {
+		logger.Info("Config check passed")
+	} else {
+		logger.Warn("Config check found problems, run with -check for a full report", zap.Int("problems", problems))
+	}
+}
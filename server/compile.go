@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// runJob executes every step of the job's preset in order, streaming process output through
+// j.send. It returns the variable map used for expansion so the caller can locate the BSP.
+func runJob(j *job) (map[string]string, error) {
+	vmf, err := j.ws.prepare(j.vmfPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare workspace: %w", err)
+	}
+
+	vars := withParams(buildVarMap(j.cfg, j.ws, vmf), j.params)
+
+	j.send("info", "Starting compile...")
+	var outcomes stepOutcomes
+	for _, step := range j.preset.Steps {
+		if j.ctx.Err() != nil {
+			return vars, errJobCancelled
+		}
+
+		run, err := evalWhen(step.When, vars, outcomes)
+		if err != nil {
+			return vars, fmt.Errorf("step %s: %w", step.Program, err)
+		}
+		if !run {
+			j.skipStep(step.Program)
+			j.send("info", "Skipping "+step.Program+": condition not met: "+step.When)
+			continue
+		}
+
+		idx := j.beginStep(step.Program)
+		attempts := 0
+		for {
+			attempts++
+			err = attemptStep(j, step, vars)
+			if err == nil || errors.Is(err, errJobCancelled) || attempts > step.Retries {
+				break
+			}
+
+			j.send("info", fmt.Sprintf("%s failed (%v), retrying (attempt %d of %d)", step.Program, err, attempts+1, step.Retries+1))
+		}
+
+		tolerated := err != nil && step.ContinueOnError && !errors.Is(err, errJobCancelled)
+		j.endStep(idx, attempts, exitCodeOf(err), err, tolerated)
+		outcomes.record(step.Program, err)
+		if tolerated {
+			j.send("info", step.Program+" failed, continuing: "+err.Error())
+			continue
+		}
+		if err != nil {
+			return vars, err
+		}
+
+		j.send("step_done", step.Program)
+	}
+
+	return vars, nil
+}
+
+// attemptStep runs the step once, within its timeout if it has one.
+func attemptStep(j *job, step Step, vars map[string]string) error {
+	ctx, cancel := j.ctx, context.CancelFunc(func() {})
+	if d := step.timeout(); d > 0 {
+		ctx, cancel = context.WithTimeout(j.ctx, d)
+	}
+	defer cancel()
+
+	return runStep(ctx, j, step, vars)
+}
+
+func runStep(ctx context.Context, j *job, step Step, vars map[string]string) error {
+	progPath := j.cfg.Programs[step.Program]
+	if progPath == "" {
+		return errors.New("program not configured: " + step.Program)
+	}
+
+	resolvedPath := resolveProgramPath(j.cfg, progPath)
+	expanded := expandArgs(step.Args, vars)
+
+	// Build command and args, with Wine wrapping on Linux for .exe
+	var cmdName string
+	var cmdArgs []string
+	useWine := runtime.GOOS == "linux" && strings.HasSuffix(strings.ToLower(resolvedPath), ".exe")
+	if useWine {
+		wine := j.cfg.WinePath
+		if wine == "" {
+			wine = "wine"
+		}
+		// Convert Unix absolute paths in arguments to Wine (Z:\\) paths so Windows tools
+		// don't treat them as relative and prepend the working directory.
+		for i, a := range expanded {
+			if len(a) > 0 && strings.HasPrefix(a, "/") {
+				// Map /foo/bar -> Z:\\foo\\bar
+				repl := strings.ReplaceAll(a, "/", "\\")
+				if strings.HasPrefix(repl, "\\") {
+					repl = repl[1:]
+				}
+				expanded[i] = "Z:\\" + repl
+			}
+		}
+		cmdName = wine
+		cmdArgs = append([]string{resolvedPath}, expanded...)
+	} else {
+		cmdName = resolvedPath
+		cmdArgs = expanded
+	}
+
+	j.send("info", "Running "+cmdName+" with args: "+joinArgs(cmdArgs))
+
+	cmd := exec.CommandContext(ctx, cmdName, cmdArgs...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessTree(cmd)
+	}
+	// Set working directory:
+	// - For Windows tools (.exe), set to the executable directory so dependent DLLs (e.g., filesystem_stdio.dll)
+	//   are found alongside the tool. This applies when running under Wine on Linux or natively on Windows.
+	// - For non-Windows binaries, keep the VMF directory so any relative paths in args resolve there.
+	workDir := vars["$path"]
+	if strings.HasSuffix(strings.ToLower(resolvedPath), ".exe") {
+		workDir = filepath.Dir(resolvedPath)
+	}
+	cmd.Dir = workDir
+	if useWine {
+		cmd.Env = append(os.Environ(), "WINEDEBUG=-all")
+		if j.cfg.WinePrefix != "" {
+			cmd.Env = append(cmd.Env, "WINEPREFIX="+j.cfg.WinePrefix)
+		}
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.New("cannot get stdout: " + err.Error())
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.New("cannot get stderr: " + err.Error())
+	}
+
+	if err := cmd.Start(); err != nil {
+		if j.ctx.Err() != nil {
+			return errJobCancelled
+		}
+		if ctx.Err() != nil {
+			return errors.New("timed out after " + step.Timeout)
+		}
+
+		return errors.New("failed to start: " + err.Error())
+	}
+
+	// Stream output
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		scan := bufio.NewScanner(stdout)
+		for scan.Scan() {
+			j.send(step.Program, scan.Text())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		scan := bufio.NewScanner(stderr)
+		for scan.Scan() {
+			j.send(step.Program, scan.Text())
+		}
+	}()
+
+	wg.Wait()
+
+	if err := cmd.Wait(); err != nil {
+		if j.ctx.Err() != nil {
+			return errJobCancelled
+		}
+		if ctx.Err() != nil {
+			return errors.New("timed out after " + step.Timeout)
+		}
+
+		return fmt.Errorf("process exited with error: %w", err)
+	}
+
+	return nil
+}
+
+// exitCodeOf extracts the process exit code from a runStep error: 0 for success and -1 when
+// the process never ran to completion.
+func exitCodeOf(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	return -1
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// Step outcomes a `when` condition can test.
+const (
+	outcomeSucceeded = "succeeded"
+	outcomeFailed    = "failed"
+)
+
+// stepOutcomes tracks how the steps that ran so far ended, for evaluating `when` conditions.
+type stepOutcomes struct {
+	last      string            // outcome of the most recent step that ran
+	byProgram map[string]string // outcome of the most recent run of each program
+}
+
+func (o *stepOutcomes) record(program string, err error) {
+	outcome := outcomeSucceeded
+	if err != nil {
+		outcome = outcomeFailed
+	}
+
+	if o.byProgram == nil {
+		o.byProgram = map[string]string{}
+	}
+	o.last = outcome
+	o.byProgram[program] = outcome
+}
+
+// evalWhen evaluates a step condition. The grammar is deliberately small:
+//
+//	cond   = and { "||" and }
+//	and    = term { "&&" term }
+//	term   = "always" | "succeeded" | "failed"      outcome of the previous step that ran
+//	       | program ".succeeded" | program ".failed"
+//	       | ["!"] "$param"                          bool parameter
+//	       | "$param" ("==" | "!=") value
+//
+// An empty condition is true.
+func evalWhen(cond string, vars map[string]string, outcomes stepOutcomes) (bool, error) {
+	if strings.TrimSpace(cond) == "" {
+		return true, nil
+	}
+
+	for _, alt := range strings.Split(cond, "||") {
+		all := true
+		for _, term := range strings.Split(alt, "&&") {
+			ok, err := evalTerm(strings.TrimSpace(term), vars, outcomes)
+			if err != nil {
+				return false, err
+			}
+			all = all && ok
+		}
+
+		if all {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func evalTerm(term string, vars map[string]string, outcomes stepOutcomes) (bool, error) {
+	switch term {
+	case "":
+		return false, errors.New("empty condition")
+	case "always":
+		return true, nil
+	case outcomeSucceeded, outcomeFailed:
+		// Before any step ran, nothing has failed.
+		last := outcomes.last
+		if last == "" {
+			last = outcomeSucceeded
+		}
+		return last == term, nil
+	}
+
+	if strings.HasPrefix(term, "$") || strings.HasPrefix(term, "!$") {
+		for _, op := range []string{"==", "!="} {
+			if name, value, ok := strings.Cut(term, op); ok {
+				name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+				v, known := vars[name]
+				if !known {
+					return false, errors.New("unknown parameter in condition: " + name)
+				}
+				return (v == strings.Trim(value, `"`)) == (op == "=="), nil
+			}
+		}
+
+		negate := strings.HasPrefix(term, "!")
+		name := strings.TrimPrefix(term, "!")
+		v, known := vars[name]
+		if !known || (v != "true" && v != "false") {
+			return false, errors.New("condition needs a bool parameter: " + name)
+		}
+		return (v == "true") != negate, nil
+	}
+
+	if program, outcome, ok := strings.Cut(term, "."); ok && (outcome == outcomeSucceeded || outcome == outcomeFailed) {
+		return outcomes.byProgram[program] == outcome, nil
+	}
+
+	return false, errors.New("cannot parse condition: " + term)
+}
+
+// validateConditions checks every step's condition of a resolved preset against its
+// parameters and the steps that come before it, by evaluating it with placeholder values.
+func validateConditions(p Preset, params []presetParam) error {
+	vars := map[string]string{}
+	for _, pp := range params {
+		vars[pp.Name] = pp.Default
+		if pp.Type == paramBool {
+			vars[pp.Name] = "false"
+		}
+	}
+
+	var outcomes stepOutcomes
+	for _, s := range p.Steps {
+		if _, err := evalWhen(s.When, vars, outcomes); err != nil {
+			return errors.New("step " + s.Program + ": " + err.Error())
+		}
+
+		for _, alt := range strings.Split(s.When, "||") {
+			for _, term := range strings.Split(alt, "&&") {
+				program, outcome, ok := strings.Cut(strings.TrimSpace(term), ".")
+				if ok && !strings.HasPrefix(program, "$") && (outcome == outcomeSucceeded || outcome == outcomeFailed) {
+					if _, ran := outcomes.byProgram[program]; !ran {
+						return errors.New("step " + s.Program + ": condition refers to " + program + ", which has no earlier step")
+					}
+				}
+			}
+		}
+
+		outcomes.record(s.Program, nil)
+	}
+
+	return nil
+}
@@ -1,12 +1,20 @@
 package server
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
+	"maps"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
+
+	"go.uber.org/zap"
 )
 
 type Config struct {
@@ -14,52 +22,270 @@ type Config struct {
 	Programs     map[string]string `json:"programs"`               // name -> absolute path
 	BaseGamePath string            `json:"baseGamePath,omitempty"` // e.g., C:/Program Files/Steam/steamapps/common/garrysmod
 	WinePath     string            `json:"winePath,omitempty"`     // optional override for wine binary
+	WinePrefix   string            `json:"winePrefix,omitempty"`   // WINEPREFIX for Windows tools, if not the default
 	// Optional overrides for variable expansion. if empty, values are derived.
 	GameDir string `json:"gamedir,omitempty"`
 	ExeDir  string `json:"exedir,omitempty"`
-	BspDir  string `json:"bspdir,omitempty"`
-	TmpDir  string `json:"tmp,omitempty"`
+	BspDir  string `json:"bspdir,omitempty"` // compiled BSPs are also copied here, if set
+	TmpDir  string `json:"tmp,omitempty"`    // used as the workspace root if WorkspaceRoot isn't set
+
+	// Each job runs in its own directory under WorkspaceRoot (default <dataDir>/workspaces).
+	// WorkspaceCleanup decides which are removed when the job finishes: "always", "onSuccess"
+	// (the default) or "never". Kept ones are removed after WorkspaceRetention (a Go duration,
+	// default 24h; negative keeps them).
+	WorkspaceRoot      string `json:"workspaceRoot,omitempty"`
+	WorkspaceCleanup   string `json:"workspaceCleanup,omitempty"`
+	WorkspaceRetention string `json:"workspaceRetention,omitempty"`
+
+	// Maximum number of compile jobs running at once. Further requests wait in a FIFO queue.
+	// Defaults to 1 when unset.
+	MaxConcurrentJobs int `json:"maxConcurrentJobs,omitempty"`
+	// Largest VMF a client may upload, in MiB. Zero uses the default of 512; a negative value
+	// disables the limit.
+	MaxUploadMB int `json:"maxUploadMB,omitempty"`
+
+	// Directory for server state such as job history and logs. Defaults to "data".
+	DataDir string `json:"dataDir,omitempty"`
+	// Job history retention: records older than HistoryMaxAge (a Go duration such as "720h") or
+	// beyond the newest HistoryMaxCount are dropped along with their logs. Zero uses the
+	// defaults (30 days, 1000 jobs); a negative value disables that limit.
+	HistoryMaxAge   string `json:"historyMaxAge,omitempty"`
+	HistoryMaxCount int    `json:"historyMaxCount,omitempty"`
+	// How long compiled BSPs stay downloadable after their job finished (a Go duration).
+	// Zero uses the default of 7 days; a negative value keeps them until the job leaves history.
+	ArtifactRetention string `json:"artifactRetention,omitempty"`
+
+	// Path prefix everything is served under, e.g. "/maprelay" behind a reverse proxy.
+	BasePath string `json:"basePath,omitempty"`
+	// Reverse proxies (IPs or CIDRs) whose X-Forwarded-For header is believed when working out
+	// which client a request came from; see clientIP.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+
+	// Serve HTTPS/WSS with this certificate and key (PEM files).
+	TLSCert string `json:"tlsCert,omitempty"`
+	TLSKey  string `json:"tlsKey,omitempty"`
+	// Generate a self-signed certificate on first run if the files don't exist. Paths default to
+	// <dataDir>/tls/cert.pem and key.pem; TLSHosts adds names or IPs to the certificate.
+	TLSSelfSigned bool     `json:"tlsSelfSigned,omitempty"`
+	TLSHosts      []string `json:"tlsHosts,omitempty"`
+
+	// Named game installs to compile for. Presets and compile requests pick one by name;
+	// DefaultProfile applies when neither does. Without profiles the settings above are used.
+	Profiles       map[string]GameProfile `json:"profiles,omitempty"`
+	DefaultProfile string                 `json:"defaultProfile,omitempty"`
+
+	// Set by forProfile on the config a job runs with.
+	profileName string
+}
+
+// GameProfile describes one game install. Its programs are layered over the top-level
+// programs, with vbsp/vvis/vrad derived from its own BaseGamePath.
+type GameProfile struct {
+	BaseGamePath string            `json:"baseGamePath"`
+	GameDir      string            `json:"gamedir,omitempty"`
+	ExeDir       string            `json:"exedir,omitempty"`
+	Programs     map[string]string `json:"programs,omitempty"`
+	WinePath     string            `json:"winePath,omitempty"`
+	WinePrefix   string            `json:"winePrefix,omitempty"`
+}
+
+// forProfile returns the config a job runs with under the named game profile. An empty name
+// selects DefaultProfile, or the top-level settings if there is none. The game paths come from
+// the profile alone; Wine settings fall back to the top-level ones.
+func (c Config) forProfile(name string) (Config, error) {
+	if name == "" {
+		name = c.DefaultProfile
+	}
+	if name == "" {
+		return c, nil
+	}
+
+	prof, ok := c.Profiles[name]
+	if !ok {
+		return Config{}, errors.New("unknown game profile: " + name)
+	}
+
+	out := c
+	out.profileName = name
+	out.BaseGamePath = prof.BaseGamePath
+	out.GameDir = prof.GameDir
+	out.ExeDir = prof.ExeDir
+	if prof.WinePath != "" {
+		out.WinePath = prof.WinePath
+	}
+	if prof.WinePrefix != "" {
+		out.WinePrefix = prof.WinePrefix
+	}
+
+	own := Config{BaseGamePath: prof.BaseGamePath, Programs: maps.Clone(prof.Programs)}
+	if own.Programs == nil {
+		own.Programs = map[string]string{}
+	}
+	deriveDefaultPrograms(&own)
+
+	out.Programs = maps.Clone(c.Programs)
+	if out.Programs == nil {
+		out.Programs = map[string]string{}
+	}
+	maps.Copy(out.Programs, own.Programs)
+
+	return out, nil
+}
+
+const (
+	defaultDataDir         = "data"
+	defaultHistoryMaxAge   = 30 * 24 * time.Hour
+	defaultHistoryMaxCount = 1000
+
+	defaultArtifactRetention = 7 * 24 * time.Hour
+
+	defaultMaxUploadMB = 512
+)
+
+// gameDir returns GameDir, resolved against BaseGamePath when it is a bare folder name such as
+// "garrysmod" or "hl2".
+func (c Config) gameDir() string {
+	if c.GameDir != "" && !filepath.IsAbs(c.GameDir) && c.BaseGamePath != "" {
+		return filepath.Join(c.BaseGamePath, c.GameDir)
+	}
+
+	return c.GameDir
+}
+
+func (c Config) dataDir() string {
+	if c.DataDir == "" {
+		return defaultDataDir
+	}
+
+	return c.DataDir
+}
+
+// historyMaxAge returns the history age limit, or 0 for no limit.
+func (c Config) historyMaxAge() time.Duration {
+	return durationSetting("historyMaxAge", c.HistoryMaxAge, defaultHistoryMaxAge)
+}
+
+// artifactRetention returns how long artifacts are kept, or 0 for no limit.
+func (c Config) artifactRetention() time.Duration {
+	return durationSetting("artifactRetention", c.ArtifactRetention, defaultArtifactRetention)
+}
+
+// durationSetting parses a duration config value, falling back to def when it is empty or
+// invalid. Negative durations mean "no limit" and are returned as 0.
+func durationSetting(name, value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Warn("Invalid "+name+", using default", zap.String("value", value), zap.Error(err))
+		return def
+	}
+
+	if d < 0 {
+		return 0
+	}
+
+	return d
 }
 
+// historyMaxCount returns the history size limit, or 0 for no limit.
+func (c Config) historyMaxCount() int {
+	switch {
+	case c.HistoryMaxCount == 0:
+		return defaultHistoryMaxCount
+	case c.HistoryMaxCount < 0:
+		return 0
+	}
+
+	return c.HistoryMaxCount
+}
+
+// maxUploadSize returns the upload size limit in bytes, or 0 for no limit.
+func (c Config) maxUploadSize() int64 {
+	switch {
+	case c.MaxUploadMB == 0:
+		return defaultMaxUploadMB << 20
+	case c.MaxUploadMB < 0:
+		return 0
+	}
+
+	return int64(c.MaxUploadMB) << 20
+}
+
+// The active config. It is replaced as a whole when the config file is reloaded, so callers
+// take a copy with currentConfig and jobs keep the one they were created with.
 var (
-	config     Config
-	configOnce sync.Once
+	configMu sync.RWMutex
+	config   Config
 )
 
+func currentConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	return config
+}
+
+func setConfig(c Config) {
+	configMu.Lock()
+	config = c
+	configMu.Unlock()
+}
+
+// LoadConfig reads the config file, writing a default one if it doesn't exist yet. A file that
+// exists but can't be read or parsed is an error and is left alone.
 func LoadConfig(path string) (Config, error) {
-	var err error
-	configOnce.Do(func() {
-		conf, e := readConfig(path)
-		if e != nil {
-			def := Config{Password: "", Programs: map[string]string{}}
-			_ = writeConfig(path, def)
-			conf = def
+	conf, err := readConfig(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		def := defaultConfig()
+		if err := writeConfig(path, def); err != nil {
+			return Config{}, err
 		}
+		logger.Info("Wrote default config", zap.String("path", path))
+		return def, nil
+	}
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
 
-		config = conf
-		err = nil
-	})
+	return conf, nil
+}
 
-	return config, err
+// peekConfig is LoadConfig for dry runs such as -check: a missing file yields the default
+// config without writing it.
+func peekConfig(path string) (Config, error) {
+	conf, err := readConfig(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return defaultConfig(), nil
+	}
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return conf, nil
+}
+
+func defaultConfig() Config {
+	return Config{Password: "", Programs: map[string]string{}}
 }
 
+// readConfig parses the config file only; see layerConfig for the effective settings.
 func readConfig(path string) (Config, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return Config{}, err
 	}
 
+	// Unknown fields are most likely typos ("baseGamepath") that would otherwise be ignored.
 	var c Config
-	if err := json.Unmarshal(b, &c); err != nil {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
 		return Config{}, err
 	}
 
-	if c.Programs == nil {
-		c.Programs = map[string]string{}
-	}
-
-	// Derive default program paths from BaseGamePath if provided.
-	deriveDefaultPrograms(&c)
 	return c, nil
 }
 
@@ -69,7 +295,7 @@ func writeConfig(path string, c Config) error {
 		return err
 	}
 
-	if err := os.WriteFile(path, b, fs.FileMode(0644)); err != nil {
+	if err := writeFileAtomic(path, b, fs.FileMode(0644)); err != nil {
 		return err
 	}
 
@@ -96,13 +322,25 @@ func deriveDefaultPrograms(c *Config) {
 }
 
 func CheckPassword(provided string) error {
-	if config.Password == "" {
+	password := currentConfig().Password
+	if password == "" {
 		return nil
 	}
 
-	if provided != config.Password {
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(password)) != 1 {
 		return errors.New("unauthorized")
 	}
 
 	return nil
 }
+
+// basePath returns the configured path prefix with a leading slash and no trailing slash, or ""
+// when the server is mounted at the root.
+func (c Config) basePath() string {
+	p := strings.Trim(c.BasePath, "/")
+	if p == "" {
+		return ""
+	}
+
+	return "/" + p
+}
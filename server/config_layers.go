@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Every Config field can be overridden from the environment and from server flags, named after
+// its JSON key: baseGamePath is MAPRELAY_BASE_GAME_PATH and -baseGamePath. Precedence is
+// flags > environment > config file > built-in defaults.
+const envPrefix = "MAPRELAY_"
+
+// configField describes one overridable Config field.
+type configField struct {
+	name  string // JSON key
+	index int
+}
+
+func configFields() []configField {
+	t := reflect.TypeOf(Config{})
+	fields := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields = append(fields, configField{name: name, index: i})
+	}
+
+	return fields
+}
+
+// envName turns a JSON key into its environment variable, e.g. maxConcurrentJobs into
+// MAPRELAY_MAX_CONCURRENT_JOBS. A run of capitals is one word, so maxUploadMB becomes
+// MAPRELAY_MAX_UPLOAD_MB.
+func envName(key string) string {
+	runes := []rune(key)
+
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := !unicode.IsUpper(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+
+	return b.String()
+}
+
+// clientEnvVars are read by the client, so the server doesn't warn about them.
+var clientEnvVars = []string{"MAPRELAY_FINGERPRINT", "MAPRELAY_TOKEN"}
+
+// unknownEnvVars returns the MAPRELAY_* environment variables that match no config field,
+// which are most likely typos.
+func unknownEnvVars() []string {
+	known := map[string]bool{}
+	for _, f := range configFields() {
+		known[envName(f.name)] = true
+	}
+	for _, name := range clientEnvVars {
+		known[name] = true
+	}
+
+	var unknown []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, envPrefix) && !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+
+	sort.Strings(unknown)
+	return unknown
+}
+
+// setConfigField parses raw into the field. Maps of strings take "key=value" pairs separated by
+// commas and are merged into the existing map; string lists are comma-separated; anything
+// more structured is given as JSON.
+func setConfigField(c *Config, f configField, raw string) error {
+	v := reflect.ValueOf(c).Elem().Field(f.index)
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		v.SetInt(int64(n))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return setConfigFieldJSON(v, f, raw)
+		}
+		var list []string
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String || strings.HasPrefix(strings.TrimSpace(raw), "{") {
+			return setConfigFieldJSON(v, f, raw)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for _, pair := range strings.Split(raw, ",") {
+			k, val, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(k) == "" {
+				return errors.New(f.name + ": expected name=value pairs")
+			}
+			v.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)), reflect.ValueOf(val))
+		}
+	default:
+		return setConfigFieldJSON(v, f, raw)
+	}
+
+	return nil
+}
+
+func setConfigFieldJSON(v reflect.Value, f configField, raw string) error {
+	p := reflect.New(v.Type())
+	if err := json.Unmarshal([]byte(raw), p.Interface()); err != nil {
+		return fmt.Errorf("%s: %w", f.name, err)
+	}
+
+	v.Set(p.Elem())
+	return nil
+}
+
+// configFlags holds the config overrides given on the server command line.
+type configFlags struct {
+	values map[string]*configFlagValue
+}
+
+type configFlagValue struct {
+	raw    string
+	set    bool
+	isBool bool
+}
+
+func (v *configFlagValue) String() string { return v.raw }
+
+func (v *configFlagValue) Set(s string) error {
+	v.raw, v.set = s, true
+	return nil
+}
+
+func (v *configFlagValue) IsBoolFlag() bool { return v.isBool }
+
+func registerConfigFlags(fs *flag.FlagSet) *configFlags {
+	cf := &configFlags{values: map[string]*configFlagValue{}}
+	t := reflect.TypeOf(Config{})
+	for _, f := range configFields() {
+		v := &configFlagValue{isBool: t.Field(f.index).Type.Kind() == reflect.Bool}
+		cf.values[f.name] = v
+		fs.Var(v, f.name, "Override the "+f.name+" config setting (env "+envName(f.name)+")")
+	}
+
+	return cf
+}
+
+// layerConfig applies environment and flag overrides on top of the settings read from the
+// config file, then derives defaults that depend on them.
+func layerConfig(c Config, flags *configFlags) (Config, error) {
+	for _, f := range configFields() {
+		if raw, ok := os.LookupEnv(envName(f.name)); ok {
+			if err := setConfigField(&c, f, raw); err != nil {
+				return Config{}, fmt.Errorf("%s: %w", envName(f.name), err)
+			}
+		}
+	}
+
+	if flags != nil {
+		for _, f := range configFields() {
+			if v := flags.values[f.name]; v != nil && v.set {
+				if err := setConfigField(&c, f, v.raw); err != nil {
+					return Config{}, fmt.Errorf("-%w", err)
+				}
+			}
+		}
+	}
+
+	if c.Programs == nil {
+		c.Programs = map[string]string{}
+	}
+
+	// Derive default program paths from BaseGamePath if provided.
+	deriveDefaultPrograms(&c)
+	return c, nil
+}
+
+// redactedConfig returns c with secrets replaced, for printing.
+func redactedConfig(c Config) Config {
+	if c.Password != "" {
+		c.Password = "[redacted]"
+	}
+
+	return c
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// discoverCommand holds the `-server -discoverGames` flags, which list the Source games in the
+// local Steam libraries and optionally add them to the config as game profiles.
+type discoverCommand struct {
+	discover    bool
+	steamDirs   string
+	addProfiles bool
+}
+
+func (c *discoverCommand) register(fs *flag.FlagSet) {
+	fs.BoolVar(&c.discover, "discoverGames", false, "List Source games installed through Steam and exit")
+	fs.StringVar(&c.steamDirs, "steamDir", "", "Comma-separated Steam install folders for -discoverGames (default: the usual locations)")
+	fs.BoolVar(&c.addProfiles, "addProfiles", false, "With -discoverGames, add a game profile to the config for each game found")
+}
+
+func (c *discoverCommand) run(configPath string, asJSON bool) error {
+	var roots []string
+	for _, d := range strings.Split(c.steamDirs, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			roots = append(roots, d)
+		}
+	}
+
+	games, err := discoverSteamGames(roots)
+	if err != nil {
+		return err
+	}
+
+	if c.addProfiles {
+		return addGameProfiles(configPath, games)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(games)
+	}
+
+	if len(games) == 0 {
+		fmt.Println("No Source games found; point -steamDir at your Steam folder")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "APPID\tNAME\tGAMEDIR\tBIN\tPATH")
+	for _, g := range games {
+		bin := g.BinDir
+		if bin == "" {
+			bin = "(no compile tools)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", g.AppID, g.Name, g.GameDir, bin, g.InstallPath)
+	}
+	return tw.Flush()
+}
+
+// addGameProfiles adds a profile named after its gamedir for each game to the config file.
+// Existing profiles are left alone. A running server picks the change up on its next reload.
+func addGameProfiles(configPath string, games []steamGame) error {
+	c, err := readConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	if c.Profiles == nil {
+		c.Profiles = map[string]GameProfile{}
+	}
+
+	added := 0
+	for _, g := range games {
+		name := strings.ToLower(g.GameDir)
+		if _, ok := c.Profiles[name]; ok {
+			fmt.Printf("Kept existing profile %s\n", name)
+			continue
+		}
+		if g.BinDir == "" {
+			fmt.Printf("Skipped %s: no compile tools in %s\n", g.Name, g.InstallPath)
+			continue
+		}
+
+		c.Profiles[name] = g.profile()
+		added++
+		fmt.Printf("Added profile %s for %s\n", name, g.Name)
+	}
+
+	if added == 0 {
+		return nil
+	}
+
+	return writeConfig(configPath, c)
+}
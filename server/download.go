@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/websocket"
+)
+
+// Size of each binary frame when streaming an artifact to the client.
+const downloadChunkSize = 1 << 20
+
+// artifactHeader announces a binary artifact transfer. The client expects exactly Size bytes
+// of binary frames to follow and checks them against SHA256.
+type artifactHeader struct {
+	Type   string `json:"type"` // always "bsp"
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func (c *wsConn) writeBinary(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// sendArtifact streams the file at path, whose SHA-256 is sum, to the client as a header
+// message followed by binary frames.
+func sendArtifact(conn *wsConn, path, sum string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr := artifactHeader{Type: "bsp", Name: filepath.Base(path), Size: info.Size(), SHA256: sum}
+	if err := conn.writeJSON(hdr); err != nil {
+		return err
+	}
+
+	buf := make([]byte, downloadChunkSize)
+	var sent int64
+	for sent < hdr.Size {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if werr := conn.writeBinary(buf[:n]); werr != nil {
+				return werr
+			}
+			sent += int64(n)
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if sent != hdr.Size {
+		return errors.New("artifact changed while it was being sent")
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// historyStore persists finished jobs as JSON lines in <dataDir>/jobs.jsonl. Each job's output
+// is written to <dataDir>/logs/<id>.log while it runs.
+type historyStore struct {
+	file    string
+	logDir  string
+	mu      sync.RWMutex
+	records []jobRecord // in the order they finished
+}
+
+var history historyStore
+
+func initHistoryStore(dataDir string) error {
+	history = historyStore{
+		file:   filepath.Join(dataDir, "jobs.jsonl"),
+		logDir: filepath.Join(dataDir, "logs"),
+	}
+
+	if err := os.MkdirAll(history.logDir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Open(history.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	scan.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scan.Scan() {
+		var rec jobRecord
+		if err := json.Unmarshal(scan.Bytes(), &rec); err != nil {
+			logger.Warn("Skipping malformed job history entry", zap.Error(err))
+			continue
+		}
+
+		history.records = append(history.records, rec)
+	}
+
+	if err := scan.Err(); err != nil {
+		return err
+	}
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	return history.pruneLocked()
+}
+
+func (h *historyStore) logPath(id string) string {
+	return filepath.Join(h.logDir, id+".log")
+}
+
+// add appends a finished job and applies the retention limits.
+func (h *historyStore) add(rec jobRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.OpenFile(h.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	h.records = append(h.records, rec)
+	return h.pruneLocked()
+}
+
+// pruneLocked drops records beyond the configured age and count limits, deletes their logs and
+// rewrites the history file. Callers must hold h.mu.
+func (h *historyStore) pruneLocked() error {
+	var expired []jobRecord
+
+	keep := h.records
+	if maxAge := currentConfig().historyMaxAge(); maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		keep = slices.DeleteFunc(slices.Clone(keep), func(rec jobRecord) bool {
+			if rec.Finished.Before(cutoff) {
+				expired = append(expired, rec)
+				return true
+			}
+			return false
+		})
+	}
+
+	if maxCount := currentConfig().historyMaxCount(); maxCount > 0 && len(keep) > maxCount {
+		expired = append(expired, keep[:len(keep)-maxCount]...)
+		keep = keep[len(keep)-maxCount:]
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	for _, rec := range expired {
+		if rec.LogPath != "" {
+			_ = os.Remove(rec.LogPath)
+		}
+		removeArtifacts(rec.ID)
+	}
+
+	h.records = keep
+	logger.Info("Pruned job history", zap.Int("removed", len(expired)), zap.Int("kept", len(keep)))
+
+	return h.rewriteLocked()
+}
+
+func (h *historyStore) rewriteLocked() error {
+	var buf []byte
+	for _, rec := range h.records {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+
+		buf = append(buf, b...)
+		buf = append(buf, '\n')
+	}
+
+	return writeFileAtomic(h.file, buf, 0644)
+}
+
+func (h *historyStore) get(id string) (jobRecord, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, rec := range h.records {
+		if rec.ID == id {
+			return rec, true
+		}
+	}
+
+	return jobRecord{}, false
+}
+
+// list returns every stored record, newest first.
+func (h *historyStore) list() []jobRecord {
+	h.mu.RLock()
+	arr := slices.Clone(h.records)
+	h.mu.RUnlock()
+
+	sort.Slice(arr, func(a, b int) bool {
+		return arr[a].Created.After(arr[b].Created)
+	})
+
+	return arr
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
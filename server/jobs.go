@@ -0,0 +1,538 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Job lifecycle states.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+var errJobCancelled = errors.New("job cancelled")
+
+func isTerminal(state string) bool {
+	return state == jobSucceeded || state == jobFailed || state == jobCancelled
+}
+
+// How long finished jobs (and their temp dirs) are kept around so clients can reattach.
+const jobRetention = time.Hour
+
+// stepRecord is the outcome of one preset step within a job.
+type stepRecord struct {
+	Program    string    `json:"program"`
+	Started    time.Time `json:"started,omitzero"`
+	Finished   time.Time `json:"finished,omitzero"`
+	DurationMs int64     `json:"durationMs"`
+	ExitCode   int       `json:"exitCode"`
+	Error      string    `json:"error,omitempty"`
+
+	Attempts  int  `json:"attempts,omitempty"`
+	Skipped   bool `json:"skipped,omitempty"`   // its `when` condition didn't hold
+	Tolerated bool `json:"tolerated,omitempty"` // failed, but the job continued (continueOnError)
+}
+
+// jobRecord is the externally visible description of a job, as served by the jobs API.
+type jobRecord struct {
+	ID       string            `json:"id"`
+	State    string            `json:"state"`
+	Preset   string            `json:"preset"`
+	Revision int               `json:"presetRevision,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+	Profile  string            `json:"profile,omitempty"` // game profile the job compiled for
+	User     string            `json:"user,omitempty"`
+	VMF      string            `json:"vmf"`
+	VMFHash  string            `json:"vmfSha256,omitempty"`
+	Created  time.Time         `json:"created"`
+	Started  time.Time         `json:"started,omitzero"`
+	Finished time.Time         `json:"finished,omitzero"`
+	Steps    []stepRecord      `json:"steps"`
+	Error    string            `json:"error,omitempty"`
+
+	// Revisions of the presets the job's preset extends, by name, as they were compiled.
+	ExtendsRevisions map[string]int `json:"extendsRevisions,omitempty"`
+
+	LogPath        string `json:"logPath,omitempty"`
+	Workspace      string `json:"workspace,omitempty"` // set if the workspace was kept
+	ArtifactPath   string `json:"artifactPath,omitempty"`
+	ArtifactSHA256 string `json:"artifactSha256,omitempty"`
+}
+
+// job is a single compile request, either waiting in the queue or occupying one of its slots.
+// It lives independently of the socket that created it: output is buffered so any number of
+// clients can attach, detach and reattach while it runs.
+type job struct {
+	id      string
+	preset  Preset
+	params  map[string]string // validated parameter values, keyed with the leading $
+	cfg     Config            // config at the time the job was created; reloads don't affect it
+	vmfPath string            // the VMF in the workspace's input dir
+	ws      workspace         // removed or kept when the job finishes, see finishWorkspace
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	rec     jobRecord
+	log     []wsMessage
+	logFile *os.File      // persistent copy of log, closed when the job finishes
+	notify  chan struct{} // closed and replaced whenever log or state changes
+
+	// Filled in by the queue once the job has run.
+	vars map[string]string
+	err  error
+
+	// Last queue position reported to the client, so we only send updates when it changes.
+	lastPos int
+}
+
+func newJob(id string, p Preset, vmfPath string, ws workspace, user string) *job {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &job{
+		id:      id,
+		preset:  p,
+		cfg:     currentConfig(),
+		vmfPath: vmfPath,
+		ws:      ws,
+		ctx:     ctx,
+		cancel:  cancel,
+		rec: jobRecord{
+			ID:       id,
+			State:    jobQueued,
+			Preset:   p.Name,
+			Revision: p.Revision,
+			User:     user,
+			VMF:      filepath.Base(vmfPath),
+			Created:  time.Now(),
+			Steps:    []stepRecord{},
+		},
+		notify: make(chan struct{}),
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isJobID reports whether s has the form newJobID produces.
+func isJobID(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 8 && s == hex.EncodeToString(b)
+}
+
+// openLog starts writing the job's output to path as well as buffering it in memory.
+func (j *job) openLog(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	j.logFile = f
+	j.rec.LogPath = path
+	j.mu.Unlock()
+
+	return nil
+}
+
+// send appends a message to the job's output buffer and wakes up attached clients.
+func (j *job) send(t, m string) {
+	j.mu.Lock()
+	j.log = append(j.log, wsMessage{Type: t, Message: m})
+	if j.logFile != nil {
+		_, _ = fmt.Fprintf(j.logFile, "[%s] %s\n", t, m)
+	}
+	j.wakeLocked()
+	j.mu.Unlock()
+}
+
+// setState moves the job to a new state. Entering a terminal state closes the log file and
+// records the job in the history store.
+func (j *job) setState(state string) {
+	if isTerminal(state) {
+		j.finishWorkspace(state)
+	}
+
+	j.mu.Lock()
+	j.rec.State = state
+	switch {
+	case state == jobRunning:
+		j.rec.Started = time.Now()
+	case isTerminal(state):
+		j.rec.Finished = time.Now()
+		if j.err != nil && !errors.Is(j.err, errJobCancelled) {
+			j.rec.Error = j.err.Error()
+		}
+		if j.logFile != nil {
+			_ = j.logFile.Close()
+			j.logFile = nil
+		}
+	}
+	j.wakeLocked()
+	rec := j.rec
+	j.mu.Unlock()
+
+	if isTerminal(state) {
+		if err := history.add(rec); err != nil {
+			logger.Error("Failed to record job history", zap.String("job", j.id), zap.Error(err))
+		}
+	}
+}
+
+func (j *job) status() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.rec.State
+}
+
+// beginStep records the start of a step and returns its index for endStep.
+func (j *job) beginStep(program string) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.rec.Steps = append(j.rec.Steps, stepRecord{Program: program, Started: time.Now(), ExitCode: -1})
+	return len(j.rec.Steps) - 1
+}
+
+func (j *job) endStep(idx, attempts, exitCode int, err error, tolerated bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := &j.rec.Steps[idx]
+	s.Finished = time.Now()
+	s.DurationMs = s.Finished.Sub(s.Started).Milliseconds()
+	s.ExitCode = exitCode
+	s.Attempts = attempts
+	s.Tolerated = tolerated
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// skipStep records a step whose condition didn't hold.
+func (j *job) skipStep(program string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.rec.Steps = append(j.rec.Steps, stepRecord{Program: program, ExitCode: -1, Skipped: true})
+}
+
+// record returns a copy of the job's record that is safe to use without holding the lock.
+func (j *job) record() jobRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	rec := j.rec
+	rec.Steps = append([]stepRecord{}, j.rec.Steps...)
+	return rec
+}
+
+// messages returns a copy of everything the job has output so far.
+func (j *job) messages() []wsMessage {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return append([]wsMessage{}, j.log...)
+}
+
+func (j *job) logLen() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return len(j.log)
+}
+
+// requestCancel stops the job: a queued job is dropped from the queue, a running one has its
+// step process tree killed. It returns false if the job had already finished.
+func (j *job) requestCancel() bool {
+	if isTerminal(j.status()) {
+		return false
+	}
+
+	if queue.remove(j) {
+		j.cancel()
+		j.send("cancelled", "Job cancelled before it started")
+		j.setState(jobCancelled)
+		return true
+	}
+
+	j.cancel()
+	return true
+}
+
+func (j *job) wakeLocked() {
+	close(j.notify)
+	j.notify = make(chan struct{})
+}
+
+// since returns buffered messages starting at index from. The returned channel is closed when
+// more output arrives; it is nil once the job has finished and nothing is left to read.
+func (j *job) since(from int) ([]wsMessage, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var msgs []wsMessage
+	if from < len(j.log) {
+		msgs = append(msgs, j.log[from:]...)
+	}
+
+	if isTerminal(j.rec.State) && from+len(msgs) == len(j.log) {
+		return msgs, nil
+	}
+
+	return msgs, j.notify
+}
+
+// jobRegistry keeps every known job by ID, including finished ones until they are reaped.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+var jobs = jobRegistry{jobs: map[string]*job{}}
+
+func (r *jobRegistry) add(j *job) {
+	r.mu.Lock()
+	r.jobs[j.id] = j
+	r.mu.Unlock()
+}
+
+// list returns every known job, newest first.
+func (r *jobRegistry) list() []*job {
+	r.mu.Lock()
+	arr := make([]*job, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		arr = append(arr, j)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(arr, func(a, b int) bool {
+		return arr[a].rec.Created.After(arr[b].rec.Created)
+	})
+
+	return arr
+}
+
+func (r *jobRegistry) get(id string) (*job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j, ok := r.jobs[id]
+	return j, ok
+}
+
+// reap drops finished jobs older than jobRetention.
+func (r *jobRegistry) reap() {
+	r.mu.Lock()
+	var expired []*job
+	for id, j := range r.jobs {
+		j.mu.Lock()
+		old := isTerminal(j.rec.State) && time.Since(j.rec.Finished) > jobRetention
+		j.mu.Unlock()
+
+		if old {
+			expired = append(expired, j)
+			delete(r.jobs, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, j := range expired {
+		logger.Info("Reaped finished job", zap.String("job", j.id))
+	}
+}
+
+func reapJobsPeriodically() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+
+	for range t.C {
+		jobs.reap()
+		pruneArtifacts()
+		pruneWorkspaces()
+	}
+}
+
+// jobQueue runs jobs in FIFO order with at most Config.MaxConcurrentJobs running at once.
+type jobQueue struct {
+	mu      sync.Mutex
+	running int
+	waiting []*job
+}
+
+var queue jobQueue
+
+func maxConcurrentJobs() int {
+	n := currentConfig().MaxConcurrentJobs
+	if n <= 0 {
+		return 1
+	}
+
+	return n
+}
+
+// submit appends j to the queue and starts it right away if a slot is free.
+func (q *jobQueue) submit(j *job) {
+	q.mu.Lock()
+	q.waiting = append(q.waiting, j)
+	notify := q.dispatchLocked()
+	q.mu.Unlock()
+
+	notifyPositions(notify)
+}
+
+// redispatch starts waiting jobs after maxConcurrentJobs was raised by a config reload.
+func (q *jobQueue) redispatch() {
+	q.mu.Lock()
+	notify := q.dispatchLocked()
+	q.mu.Unlock()
+
+	notifyPositions(notify)
+}
+
+// remove drops j from the waiting list, returning false if it is not waiting (already running
+// or finished).
+func (q *jobQueue) remove(j *job) bool {
+	q.mu.Lock()
+	idx := -1
+	for i, w := range q.waiting {
+		if w == j {
+			idx = i
+			break
+		}
+	}
+
+	if idx < 0 {
+		q.mu.Unlock()
+		return false
+	}
+
+	q.waiting = append(q.waiting[:idx], q.waiting[idx+1:]...)
+	notify := q.dispatchLocked()
+	q.mu.Unlock()
+
+	notifyPositions(notify)
+	return true
+}
+
+// queuedNotice is a position update for a waiting job, collected under the queue lock and
+// delivered after it is released.
+type queuedNotice struct {
+	j   *job
+	pos int
+}
+
+// dispatchLocked starts waiting jobs while slots are available and returns position updates
+// for the jobs that moved. Callers must hold q.mu.
+func (q *jobQueue) dispatchLocked() []queuedNotice {
+	for len(q.waiting) > 0 && q.running < maxConcurrentJobs() {
+		j := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running++
+		go q.run(j)
+	}
+
+	var changed []queuedNotice
+	for i, j := range q.waiting {
+		if j.lastPos != i+1 {
+			j.lastPos = i + 1
+			changed = append(changed, queuedNotice{j: j, pos: i + 1})
+		}
+	}
+
+	return changed
+}
+
+func (q *jobQueue) run(j *job) {
+	defer func() {
+		q.mu.Lock()
+		q.running--
+		notify := q.dispatchLocked()
+		q.mu.Unlock()
+
+		notifyPositions(notify)
+	}()
+
+	defer j.cancel()
+
+	j.setState(jobRunning)
+	j.vars, j.err = runJob(j)
+	if errors.Is(j.err, errJobCancelled) {
+		j.send("cancelled", "Job cancelled")
+		j.setState(jobCancelled)
+		return
+	}
+
+	if j.err == nil {
+		j.err = j.keepArtifact()
+	}
+
+	if j.err != nil {
+		j.send("error", j.err.Error())
+		j.setState(jobFailed)
+		return
+	}
+
+	j.setState(jobSucceeded)
+}
+
+// keepArtifact moves the compiled BSP into the workspace's output dir, adds it to the artifact
+// store and records where it went. With bspdir configured it is copied there too.
+func (j *job) keepArtifact() error {
+	bsp := j.vars["$bsp"]
+	if bsp == "" {
+		return nil
+	}
+
+	out := filepath.Join(j.ws.output(), filepath.Base(bsp))
+	if err := os.Rename(bsp, out); err != nil {
+		return fmt.Errorf("failed to store bsp: %w", err)
+	}
+
+	path, sum, err := storeArtifact(j, out)
+	if err != nil {
+		return fmt.Errorf("failed to store bsp: %w", err)
+	}
+
+	j.mu.Lock()
+	j.rec.ArtifactPath = path
+	j.rec.ArtifactSHA256 = sum
+	j.mu.Unlock()
+
+	if j.cfg.BspDir != "" {
+		dst, err := publishBSP(j.cfg.BspDir, out, j.id)
+		if err != nil {
+			return fmt.Errorf("failed to copy bsp to bspdir: %w", err)
+		}
+		j.send("info", "Copied BSP to "+dst)
+	}
+
+	return nil
+}
+
+// notifyPositions tells waiting clients where they are in the queue. It is called without
+// holding the queue lock since sends may block on a slow socket.
+func notifyPositions(notices []queuedNotice) {
+	for _, n := range notices {
+		n.j.send("queued", fmt.Sprintf("Queued at position %d", n.pos))
+	}
+}
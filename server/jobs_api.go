@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+)
+
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := requireRole(w, r, roleViewer); !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	state, preset, user := q.Get("state"), q.Get("preset"), q.Get("user")
+
+	arr := []jobRecord{}
+	for _, rec := range allJobRecords() {
+		if state != "" && rec.State != state {
+			continue
+		}
+		if preset != "" && rec.Preset != preset {
+			continue
+		}
+		if user != "" && rec.User != user {
+			continue
+		}
+		arr = append(arr, rec)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_ = json.NewEncoder(w).Encode(arr)
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	rec, ok := jobFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_ = json.NewEncoder(w).Encode(rec)
+}
+
+// handleGetJobLog serves the job's captured output as plain text, one line per message,
+// prefixed with the message type (the program name for tool output).
+func handleGetJobLog(w http.ResponseWriter, r *http.Request) {
+	rec, ok := jobFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if rec.LogPath != "" {
+		f, err := os.Open(rec.LogPath)
+		if err != nil {
+			http.Error(w, "log not available", http.StatusNotFound)
+			return
+		}
+
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.Copy(w, f)
+		return
+	}
+
+	j, ok := jobs.get(rec.ID)
+	if !ok {
+		http.Error(w, "log not available", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	for _, m := range j.messages() {
+		_, _ = fmt.Fprintf(w, "[%s] %s\n", m.Type, m.Message)
+	}
+}
+
+// allJobRecords merges live jobs with the persisted history, newest first.
+func allJobRecords() []jobRecord {
+	arr := []jobRecord{}
+	live := map[string]bool{}
+	for _, j := range jobs.list() {
+		live[j.id] = true
+		arr = append(arr, j.record())
+	}
+
+	for _, rec := range history.list() {
+		if !live[rec.ID] {
+			arr = append(arr, rec)
+		}
+	}
+
+	sort.SliceStable(arr, func(a, b int) bool {
+		return arr[a].Created.After(arr[b].Created)
+	})
+
+	return arr
+}
+
+// lookupJobRecord finds a job by ID among live jobs first, then in the history store.
+func lookupJobRecord(id string) (jobRecord, bool) {
+	if j, ok := jobs.get(id); ok {
+		return j.record(), true
+	}
+
+	return history.get(id)
+}
+
+// jobFromRequest checks method and credentials and looks up the job named by the {id} path
+// segment, writing the error response itself when it returns false.
+func jobFromRequest(w http.ResponseWriter, r *http.Request) (jobRecord, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return jobRecord{}, false
+	}
+
+	if _, ok := requireRole(w, r, roleViewer); !ok {
+		return jobRecord{}, false
+	}
+
+	rec, ok := lookupJobRecord(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return jobRecord{}, false
+	}
+
+	return rec, true
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"MapRelay/logging"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var authLogger = logging.Named("Auth")
+
+// Brute-force protection: each client IP gets lockoutFreeAttempts failed logins for free,
+// after which every further failure locks it out for lockoutBase, doubling each time up to
+// lockoutMax. A successful login clears the record; idle records are forgotten after
+// lockoutForget. At most lockoutMaxEntries IPs are tracked, so a flood of addresses (possibly
+// spoofed through a trusted proxy) can't grow the table without bound.
+const (
+	lockoutFreeAttempts = 5
+	lockoutBase         = 30 * time.Second
+	lockoutMax          = time.Hour
+	lockoutForget       = 24 * time.Hour
+	lockoutMaxEntries   = 10000
+	lockoutSweepEvery   = 10 * time.Minute
+)
+
+var errLockedOut = errors.New("too many failed attempts")
+
+type failedAttempts struct {
+	IP          string    `json:"ip"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil,omitzero"`
+}
+
+type lockoutTracker struct {
+	mu        sync.Mutex
+	entries   map[string]*failedAttempts
+	lastSweep time.Time
+}
+
+var lockouts = lockoutTracker{entries: map[string]*failedAttempts{}}
+
+// check returns errLockedOut and the remaining time while ip is locked out.
+func (t *lockoutTracker) check(ip string) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[ip]
+	if !ok {
+		return 0, nil
+	}
+
+	if left := time.Until(e.LockedUntil); left > 0 {
+		return left, errLockedOut
+	}
+
+	return 0, nil
+}
+
+func (t *lockoutTracker) fail(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.lastSweep) > lockoutSweepEvery {
+		t.sweepLocked()
+	}
+
+	e, ok := t.entries[ip]
+	if !ok || time.Since(e.LastFailure) > lockoutForget {
+		if !ok && len(t.entries) >= lockoutMaxEntries {
+			t.evictLocked()
+		}
+		e = &failedAttempts{IP: ip}
+		t.entries[ip] = e
+	}
+
+	e.Failures++
+	e.LastFailure = time.Now()
+
+	if over := e.Failures - lockoutFreeAttempts; over > 0 {
+		d := lockoutMax
+		if over <= 20 {
+			d = min(lockoutBase<<(over-1), lockoutMax)
+		}
+
+		e.LockedUntil = e.LastFailure.Add(d)
+		authLogger.Warn("Client locked out after failed authentication",
+			zap.String("ip", ip), zap.Int("failures", e.Failures), zap.Duration("duration", d))
+		return
+	}
+
+	authLogger.Info("Failed authentication", zap.String("ip", ip), zap.Int("failures", e.Failures))
+}
+
+// sweepLocked drops records idle for longer than lockoutForget. Callers must hold t.mu.
+func (t *lockoutTracker) sweepLocked() {
+	for ip, e := range t.entries {
+		if time.Since(e.LastFailure) > lockoutForget {
+			delete(t.entries, ip)
+		}
+	}
+
+	t.lastSweep = time.Now()
+}
+
+// evictLocked makes room for a new record when the table is full: forgotten records go first,
+// then the least recent one that isn't locked out, and only if every IP is locked out the least
+// recent of those. Callers must hold t.mu.
+func (t *lockoutTracker) evictLocked() {
+	t.sweepLocked()
+	if len(t.entries) < lockoutMaxEntries {
+		return
+	}
+
+	var oldest, oldestLocked *failedAttempts
+	now := time.Now()
+	for _, e := range t.entries {
+		if e.LockedUntil.After(now) {
+			if oldestLocked == nil || e.LastFailure.Before(oldestLocked.LastFailure) {
+				oldestLocked = e
+			}
+		} else if oldest == nil || e.LastFailure.Before(oldest.LastFailure) {
+			oldest = e
+		}
+	}
+
+	if oldest == nil {
+		oldest = oldestLocked
+	}
+	delete(t.entries, oldest.IP)
+}
+
+func (t *lockoutTracker) succeed(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.entries, ip)
+}
+
+// clear lifts a lockout by hand, returning false if the IP had no record.
+func (t *lockoutTracker) clear(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.entries[ip]
+	delete(t.entries, ip)
+	return ok
+}
+
+// list returns every IP with recent failures, most recent first, dropping forgotten ones.
+func (t *lockoutTracker) list() []failedAttempts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweepLocked()
+
+	arr := []failedAttempts{}
+	for _, e := range t.entries {
+		arr = append(arr, *e)
+	}
+
+	sort.Slice(arr, func(a, b int) bool {
+		return arr[a].LastFailure.After(arr[b].LastFailure)
+	})
+
+	return arr
+}
+
+// clientIP returns the address lockouts are keyed on: the host part of the request's remote
+// address or, when that is a trusted proxy, the nearest X-Forwarded-For entry that isn't one.
+// Entries left of it could have been made up by the client, so they are never used.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	proxies := parseTrustedProxies(currentConfig().TrustedProxies)
+	if !isTrustedProxy(host, proxies) {
+		return host
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+
+		host = hop
+		if !isTrustedProxy(hop, proxies) {
+			break
+		}
+	}
+
+	return host
+}
+
+// parseTrustedProxies turns trustedProxies entries into prefixes, skipping any that are neither
+// an IP nor a CIDR (-check reports those).
+func parseTrustedProxies(list []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if p, err := parseProxy(s); err == nil {
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	return prefixes
+}
+
+func parseProxy(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func isTrustedProxy(ip string, proxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	for _, p := range proxies {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// handleLockouts lists IPs with failed login attempts (GET) or lifts a lockout (DELETE
+// /api/admin/lockouts/{ip}).
+func handleLockouts(w http.ResponseWriter, r *http.Request) {
+	p, ok := requireRole(w, r, roleServerAdmin)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(lockouts.list())
+	case http.MethodDelete:
+		ip := r.PathValue("ip")
+		if ip == "" || !lockouts.clear(ip) {
+			http.Error(w, "no failed attempts recorded for this address", http.StatusNotFound)
+			return
+		}
+
+		authLogger.Info("Lockout cleared", zap.String("ip", ip), zap.String("by", p.Name))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
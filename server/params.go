@@ -0,0 +1,198 @@
+package server
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Parameter types a preset can declare.
+const (
+	paramString = "string"
+	paramInt    = "int"
+	paramBool   = "bool"
+)
+
+// presetParam is a parsed parameter declaration such as "$bounces:int=100" or "$hdr:bool".
+// Without a type the parameter is a string. Bools default to false; other parameters without
+// a default must be supplied by the client.
+type presetParam struct {
+	Name       string // including the leading $
+	Type       string
+	Default    string
+	HasDefault bool
+}
+
+// builtinVars are the variables buildVarMap always sets. Parameters can't shadow them.
+var builtinVars = []string{"$path", "$mapdir", "$file", "$name", "$tmp", "$gamedir", "$game", "$bspdir", "$bsp", "$exedir", "$vmf", "$workspace", "$indir", "$outdir", "$logdir"}
+
+func parseParam(decl string) (presetParam, error) {
+	var p presetParam
+
+	spec, def, hasDef := strings.Cut(decl, "=")
+	name, typ, _ := strings.Cut(spec, ":")
+	name = strings.TrimSpace(name)
+	if !strings.HasPrefix(name, "$") || len(name) < 2 {
+		return p, errors.New("parameter must start with $: " + decl)
+	}
+	for _, r := range name[1:] {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return p, errors.New("invalid parameter name: " + name)
+		}
+	}
+	for _, b := range builtinVars {
+		if name == b {
+			return p, errors.New("parameter shadows built-in variable: " + name)
+		}
+	}
+
+	p.Name = name
+	p.Type = strings.TrimSpace(typ)
+	if p.Type == "" {
+		p.Type = paramString
+	}
+
+	switch p.Type {
+	case paramString, paramInt, paramBool:
+	default:
+		return p, errors.New("unknown parameter type: " + p.Type)
+	}
+
+	if p.Type == paramBool && !hasDef {
+		def, hasDef = "false", true
+	}
+
+	if hasDef {
+		v, err := p.normalize(def)
+		if err != nil {
+			return p, errors.New("bad default for " + name + ": " + err.Error())
+		}
+		p.Default, p.HasDefault = v, true
+	}
+
+	return p, nil
+}
+
+// normalize checks v against the parameter's type and returns its canonical form.
+func (p presetParam) normalize(v string) (string, error) {
+	switch p.Type {
+	case paramInt:
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return "", errors.New(p.Name + " must be an integer")
+		}
+		return strconv.Itoa(n), nil
+	case paramBool:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return "", errors.New(p.Name + " must be true or false")
+		}
+		return strconv.FormatBool(b), nil
+	}
+
+	return v, nil
+}
+
+// presetParams parses all of a preset's parameter declarations.
+func presetParams(p Preset) ([]presetParam, error) {
+	params := make([]presetParam, 0, len(p.Params))
+	seen := map[string]bool{}
+	for _, decl := range p.Params {
+		pp, err := parseParam(decl)
+		if err != nil {
+			return nil, err
+		}
+		if seen[pp.Name] {
+			return nil, errors.New("duplicate parameter: " + pp.Name)
+		}
+		seen[pp.Name] = true
+		params = append(params, pp)
+	}
+
+	return params, nil
+}
+
+// mergeParams combines a parent's declarations with a child's; the child wins on name clashes.
+func mergeParams(parent, child []string) []string {
+	out := make([]string, 0, len(parent)+len(child))
+	names := map[string]int{}
+	for _, decl := range slices.Concat(parent, child) {
+		name, _, _ := strings.Cut(decl, ":")
+		name, _, _ = strings.Cut(name, "=")
+		name = strings.TrimSpace(name)
+		if i, ok := names[name]; ok {
+			out[i] = decl
+			continue
+		}
+		names[name] = len(out)
+		out = append(out, decl)
+	}
+
+	return out
+}
+
+// resolveParams validates the values a client supplied against the preset's declarations and
+// fills in defaults. Names may be given with or without the leading $.
+func resolveParams(p Preset, given map[string]string) (map[string]string, error) {
+	params, err := presetParams(p)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]presetParam{}
+	for _, pp := range params {
+		byName[pp.Name] = pp
+	}
+
+	values := map[string]string{}
+	for k, v := range given {
+		name := "$" + strings.TrimPrefix(k, "$")
+		pp, ok := byName[name]
+		if !ok {
+			return nil, errors.New("preset " + p.Name + " has no parameter " + name)
+		}
+
+		nv, err := pp.normalize(v)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = nv
+	}
+
+	for _, pp := range params {
+		if _, ok := values[pp.Name]; ok {
+			continue
+		}
+		if !pp.HasDefault {
+			return nil, errors.New("missing required parameter " + pp.Name)
+		}
+		values[pp.Name] = pp.Default
+	}
+
+	return values, nil
+}
+
+// conditionalArg handles args of the form "$flag?arg" (or "!$flag?arg"), which expand to arg
+// only when the bool parameter $flag is true (false). Other args are returned unchanged.
+func conditionalArg(a string, vars map[string]string) (string, bool) {
+	cond, rest, ok := strings.Cut(a, "?")
+	if !ok {
+		return a, true
+	}
+
+	negate := strings.HasPrefix(cond, "!")
+	v, known := vars[strings.TrimPrefix(cond, "!")]
+	if !known || (v != "true" && v != "false") {
+		return a, true
+	}
+
+	return rest, (v == "true") != negate
+}
+
+func withParams(vars, params map[string]string) map[string]string {
+	out := maps.Clone(vars)
+	maps.Copy(out, params)
+	return out
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Actions recorded with each preset revision.
+const (
+	presetSaved      = "save"
+	presetRenamed    = "rename"
+	presetDeleted    = "delete"
+	presetRolledBack = "rollback"
+)
+
+var errRevisionNotFound = errors.New("preset revision not found")
+
+// presetRevision is a snapshot of a preset after a change. Revisions are numbered per preset
+// name and never rewritten, except that renaming a preset carries its history to the new name.
+type presetRevision struct {
+	Preset
+	Action string `json:"action"`
+	Note   string `json:"note,omitempty"`
+}
+
+// loadPresetHistoryLocked reads <dataDir>/preset_history.jsonl. Callers must hold presets.mu.
+func loadPresetHistoryLocked(dataDir string) error {
+	presets.historyFile = filepath.Join(dataDir, "preset_history.jsonl")
+	presets.revisions = nil
+
+	f, err := os.Open(presets.historyFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if f != nil {
+		defer f.Close()
+
+		scan := bufio.NewScanner(f)
+		scan.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scan.Scan() {
+			var rev presetRevision
+			if err := json.Unmarshal(scan.Bytes(), &rev); err != nil {
+				logger.Warn("Skipping malformed preset history entry", zap.Error(err))
+				continue
+			}
+
+			presets.revisions = append(presets.revisions, rev)
+		}
+
+		if err := scan.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordUnversionedLocked records a first revision for presets that predate versioning or were
+// edited by hand. Callers must hold presets.mu.
+func recordUnversionedLocked() error {
+	for name, p := range presets.list {
+		if p.Revision != 0 && presets.latestRevisionLocked(name) >= p.Revision {
+			continue
+		}
+
+		p.Revision = presets.latestRevisionLocked(name) + 1
+		presets.stampParentLocked(&p)
+		presets.list[name] = p
+		if err := presets.recordLocked(p, presetSaved, "recorded at startup"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *presetStore) latestRevisionLocked(name string) int {
+	latest := 0
+	for _, rev := range s.revisions {
+		if rev.Name == name && rev.Revision > latest {
+			latest = rev.Revision
+		}
+	}
+
+	return latest
+}
+
+// stampParentLocked records which revision of the extended preset p is saved against.
+func (s *presetStore) stampParentLocked(p *Preset) {
+	p.ExtendsRevision = 0
+	if p.Extends != "" {
+		p.ExtendsRevision = s.latestRevisionLocked(p.Extends)
+	}
+}
+
+// recordLocked appends a revision to the history file. Callers must hold s.mu.
+func (s *presetStore) recordLocked(p Preset, action, note string) error {
+	rev := presetRevision{Preset: p, Action: action, Note: note}
+
+	b, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.historyFile), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	s.revisions = append(s.revisions, rev)
+	return nil
+}
+
+// renameHistoryLocked moves all revisions of name to newName and rewrites the history file.
+// Callers must hold s.mu.
+func (s *presetStore) renameHistoryLocked(name, newName string) error {
+	for i := range s.revisions {
+		if s.revisions[i].Name == name {
+			s.revisions[i].Name = newName
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rev := range s.revisions {
+		if err := enc.Encode(rev); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(s.historyFile, buf.Bytes(), 0644)
+}
+
+// presetHistory returns every revision of the named preset, newest first.
+func presetHistory(name string) []presetRevision {
+	presets.mu.RLock()
+	defer presets.mu.RUnlock()
+
+	var arr []presetRevision
+	for i := len(presets.revisions) - 1; i >= 0; i-- {
+		if presets.revisions[i].Name == name {
+			arr = append(arr, presets.revisions[i])
+		}
+	}
+
+	return arr
+}
+
+// latestRevisionsLocked returns the newest revision of every preset that isn't deleted, as a
+// fallback when presets.json itself is lost. Callers must hold presets.mu.
+func latestRevisionsLocked() []Preset {
+	latest := map[string]presetRevision{}
+	for _, rev := range presets.revisions {
+		if cur, ok := latest[rev.Name]; !ok || rev.Revision > cur.Revision {
+			latest[rev.Name] = rev
+		}
+	}
+
+	var arr []Preset
+	for _, rev := range latest {
+		if rev.Action != presetDeleted {
+			arr = append(arr, rev.Preset)
+		}
+	}
+
+	return arr
+}
+
+// getPresetRevision returns the preset as it was at the given revision.
+func getPresetRevision(name string, revision int) (Preset, error) {
+	presets.mu.RLock()
+	defer presets.mu.RUnlock()
+
+	for _, rev := range presets.revisions {
+		if rev.Name == name && rev.Revision == revision && rev.Action != presetDeleted {
+			return rev.Preset, nil
+		}
+	}
+
+	return Preset{}, errRevisionNotFound
+}
+
+// rollbackPreset stores the steps of an earlier revision as a new revision. It also restores
+// deleted presets.
+func rollbackPreset(name string, revision int, by string) (Preset, error) {
+	old, err := getPresetRevision(name, revision)
+	if err != nil {
+		return Preset{}, err
+	}
+
+	if err := checkPresetChange(old); err != nil {
+		return Preset{}, err
+	}
+
+	presets.mu.Lock()
+	// The preset's own steps come back; it extends the parent's current revision, as any save
+	// does.
+	p := old
+	p.Revision = presets.latestRevisionLocked(name) + 1
+	presets.stampParentLocked(&p)
+	p.UpdatedBy = by
+	p.UpdatedAt = time.Now()
+	presets.list[name] = p
+	err = presets.recordLocked(p, presetRolledBack, "rolled back to revision "+strconv.Itoa(revision))
+	presets.mu.Unlock()
+	if err != nil {
+		return Preset{}, err
+	}
+
+	logger.Info("Preset rolled back", zap.String("preset", name), zap.Int("to", revision), zap.Int("revision", p.Revision), zap.String("by", by))
+
+	return p, savePresets()
+}
+
+func handlePresetHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := requireRole(w, r, roleViewer); !ok {
+		return
+	}
+
+	arr := presetHistory(r.PathValue("name"))
+	if len(arr) == 0 {
+		http.Error(w, errPresetNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(arr)
+}
+
+// handlePresetRollback restores a preset to an earlier revision (POST {"revision": N}).
+func handlePresetRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	who, ok := requireRole(w, r, rolePresetAdmin)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Revision int `json:"revision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	p, err := rollbackPreset(r.PathValue("name"), body.Revision, who.Name)
+	if err != nil {
+		http.Error(w, err.Error(), statusForPresetError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Step modes for presets that extend another preset. A step is matched to the first step of
+// the parent with the same program.
+const (
+	stepOverride = "override" // replace the parent's step, options included (the default); added at the end if there is none
+	stepAppend   = "append"   // add args to the parent's step, before its map arg; added at the end if there is none
+	stepRemove   = "remove"   // drop the parent's step
+)
+
+var errPresetInUse = errors.New("preset is extended by another preset")
+
+// resolvePreset flattens p's extends chain into a plain list of steps.
+func resolvePreset(p Preset) (Preset, error) {
+	return resolvePresetWith(p, getPreset, map[string]bool{})
+}
+
+// resolveForCompile resolves p for a compile and returns the revisions of the presets it
+// extends, for the job record. A pinned revision is resolved against the parent revisions it
+// was saved with, so it compiles the same steps whatever happened to its parents since; a
+// current one against their current revisions.
+func resolveForCompile(p Preset, pinned bool) (Preset, map[string]int, error) {
+	chain := map[string]Preset{}
+	revisions := map[string]int{}
+	for cur := p; cur.Extends != ""; {
+		if _, seen := chain[cur.Extends]; seen || cur.Extends == p.Name {
+			return Preset{}, nil, errors.New("preset inheritance cycle through " + cur.Extends)
+		}
+
+		parent, ok := getPreset(cur.Extends)
+		if pinned && cur.ExtendsRevision > 0 {
+			var err error
+			parent, err = getPresetRevision(cur.Extends, cur.ExtendsRevision)
+			ok = err == nil
+		}
+		if !ok {
+			return Preset{}, nil, errors.New("extended preset not found: " + cur.Extends)
+		}
+
+		chain[parent.Name] = parent
+		revisions[parent.Name] = parent.Revision
+		cur = parent
+	}
+
+	lookup := func(name string) (Preset, bool) {
+		parent, ok := chain[name]
+		return parent, ok
+	}
+
+	resolved, err := resolvePresetWith(p, lookup, map[string]bool{})
+	if err != nil {
+		return Preset{}, nil, err
+	}
+
+	return resolved, revisions, nil
+}
+
+func resolvePresetWith(p Preset, lookup func(string) (Preset, bool), seen map[string]bool) (Preset, error) {
+	if p.Extends == "" {
+		return p, nil
+	}
+
+	seen[p.Name] = true
+	if seen[p.Extends] {
+		return Preset{}, errors.New("preset inheritance cycle through " + p.Extends)
+	}
+
+	parent, ok := lookup(p.Extends)
+	if !ok {
+		return Preset{}, errors.New("extended preset not found: " + p.Extends)
+	}
+
+	parent, err := resolvePresetWith(parent, lookup, seen)
+	if err != nil {
+		return Preset{}, err
+	}
+
+	steps := slices.Clone(parent.Steps)
+	for _, s := range p.Steps {
+		i := slices.IndexFunc(steps, func(ps Step) bool { return ps.Program == s.Program })
+
+		own := s
+		own.Mode = ""
+
+		switch s.Mode {
+		case "", stepOverride:
+			if i < 0 {
+				steps = append(steps, own)
+			} else {
+				steps[i] = own
+			}
+		case stepAppend:
+			// Only the args are appended; the parent's condition, timeout and retries stay.
+			if i < 0 {
+				steps = append(steps, own)
+			} else {
+				steps[i].Args = appendArgs(steps[i].Args, s.Args)
+			}
+		case stepRemove:
+			if i < 0 {
+				return Preset{}, errors.New("cannot remove step " + s.Program + ": not in " + p.Extends)
+			}
+			steps = slices.Delete(steps, i, i+1)
+		}
+	}
+
+	p.Steps = steps
+	p.Params = mergeParams(parent.Params, p.Params)
+	if p.Profile == "" {
+		p.Profile = parent.Profile
+	}
+	p.Extends = ""
+
+	return p, nil
+}
+
+// appendArgs adds extra to args. The Source tools take the map as their last argument and
+// reject anything after it, so a trailing map arg stays last.
+func appendArgs(args, extra []string) []string {
+	n := len(args)
+	if n > 0 && isMapArg(args[n-1]) {
+		return slices.Concat(args[:n-1], extra, args[n-1:])
+	}
+
+	return slices.Concat(args, extra)
+}
+
+// isMapArg reports whether a refers to the map being compiled.
+func isMapArg(a string) bool {
+	for _, v := range []string{"$vmf", "$bsp", "$file"} {
+		if strings.Contains(a, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateSteps checks the options of a preset's own steps before it is stored.
+func validateSteps(p Preset) error {
+	for _, s := range p.Steps {
+		if s.Timeout != "" {
+			if d, err := time.ParseDuration(s.Timeout); err != nil || d <= 0 {
+				return errors.New("step " + s.Program + ": timeout must be a positive duration such as 30m")
+			}
+		}
+
+		if s.Retries < 0 {
+			return errors.New("step " + s.Program + ": retries can't be negative")
+		}
+
+		switch s.Mode {
+		case "":
+		case stepOverride, stepAppend, stepRemove:
+			if p.Extends == "" {
+				return errors.New("step mode " + s.Mode + " needs a preset to extend")
+			}
+		default:
+			return errors.New("unknown step mode: " + s.Mode)
+		}
+	}
+
+	return nil
+}
+
+// validateResolved checks what can only be checked once extends is applied: the game profile
+// and its programs, parameter declarations and the step conditions that refer to them.
+func validateResolved(c Config, p Preset) error {
+	pc, err := c.forProfile(p.Profile)
+	if err != nil {
+		return err
+	}
+
+	if err := checkPrograms(pc, p); err != nil {
+		return err
+	}
+
+	params, err := presetParams(p)
+	if err != nil {
+		return err
+	}
+
+	return validateConditions(p, params)
+}
+
+// checkPrograms reports the first step whose program isn't configured in c.
+func checkPrograms(c Config, p Preset) error {
+	for _, s := range p.Steps {
+		if _, ok := c.Programs[s.Program]; !ok {
+			if c.profileName != "" {
+				return errors.New("unknown program in game profile " + c.profileName + ": " + s.Program)
+			}
+			return errors.New("unknown program: " + s.Program)
+		}
+	}
+
+	return nil
+}
+
+// presetChildren returns the names of presets that directly extend name.
+func presetChildren(name string) []string {
+	presets.mu.RLock()
+	defer presets.mu.RUnlock()
+
+	var names []string
+	for _, p := range presets.list {
+		if p.Extends == name {
+			names = append(names, p.Name)
+		}
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+func presetInUseError(children []string) error {
+	return fmt.Errorf("%w: %s", errPresetInUse, strings.Join(children, ", "))
+}
+
+// checkPresetChange verifies that p and every preset extending it still resolve once p is
+// stored.
+func checkPresetChange(p Preset) error {
+	lookup := func(name string) (Preset, bool) {
+		if name == p.Name {
+			return p, true
+		}
+		return getPreset(name)
+	}
+
+	cfg := currentConfig()
+	resolved, err := resolvePresetWith(p, lookup, map[string]bool{})
+	if err != nil {
+		return err
+	}
+
+	if err := validateResolved(cfg, resolved); err != nil {
+		return err
+	}
+
+	for _, other := range getAllPresets() {
+		if other.Name == p.Name || other.Extends == "" {
+			continue
+		}
+
+		resolved, err := resolvePresetWith(other, lookup, map[string]bool{})
+		if err == nil {
+			err = validateResolved(cfg, resolved)
+		}
+		if err != nil {
+			return fmt.Errorf("would break preset %s: %w", other.Name, err)
+		}
+	}
+
+	return nil
+}
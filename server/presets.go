@@ -3,10 +3,14 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/fs"
 	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -14,77 +18,222 @@ import (
 type Step struct {
 	Program string   `json:"program"` // must match a key in Config.Programs
 	Args    []string `json:"args"`
+	// How the step combines with the extended preset: "override", "append" or "remove".
+	Mode string `json:"mode,omitempty"`
+
+	// Run the step only if this condition holds; see evalWhen.
+	When string `json:"when,omitempty"`
+	// Keep going with the next step if this one fails.
+	ContinueOnError bool `json:"continueOnError,omitempty"`
+	// Kill the step after this long, as a Go duration such as "30m". Applies to each attempt.
+	Timeout string `json:"timeout,omitempty"`
+	// Run the step up to this many more times if it fails.
+	Retries int `json:"retries,omitempty"`
+}
+
+// timeout returns the step's parsed timeout, or 0 for none.
+func (s Step) timeout() time.Duration {
+	d, _ := time.ParseDuration(s.Timeout)
+	return d
 }
 
 type Preset struct {
-	Name  string `json:"name"`
-	Steps []Step `json:"steps"`
+	Name string `json:"name"`
+	// Name of a preset whose steps this one starts from; see resolvePreset.
+	Extends string `json:"extends,omitempty"`
+	// Revision of Extends when this revision was saved. Set by the server; compiles pinned to
+	// this revision resolve against it.
+	ExtendsRevision int `json:"extendsRevision,omitempty"`
+	// Game profile to compile for unless the compile request picks one; see Config.forProfile.
+	Profile string `json:"profile,omitempty"`
+	// Parameter declarations such as "$bounces:int=100" or "$hdr:bool"; see parseParam.
+	Params []string `json:"params,omitempty"`
+	Steps  []Step   `json:"steps"`
+
+	// Set by the server on every change.
+	Revision  int       `json:"revision,omitempty"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitzero"`
 }
 
 type presetStore struct {
-	file string
-	mu   sync.RWMutex
-	list map[string]Preset // name -> preset
+	file    string
+	mu      sync.RWMutex
+	saveMu  sync.Mutex
+	modTime time.Time         // of the presets file when last written or read, guarded by saveMu
+	list    map[string]Preset // name -> preset
+
+	historyFile string
+	revisions   []presetRevision // in the order they were made
 }
 
 var presets presetStore
 
-func initPresetStore(file string) error {
+var (
+	errPresetNotFound = errors.New("preset not found")
+	errPresetExists   = errors.New("preset already exists")
+)
+
+// initPresetStore loads the presets file. A file that exists but can't be parsed is never
+// overwritten: the server refuses to start unless recover is set, in which case the file is
+// moved aside and the presets are rebuilt from their history or the newest usable backup.
+func initPresetStore(file, dataDir string, recover bool) error {
 	presets = presetStore{file: file, list: map[string]Preset{}}
 
+	presets.mu.Lock()
+	defer presets.mu.Unlock()
+
+	if err := loadPresetHistoryLocked(dataDir); err != nil {
+		return err
+	}
+
+	arr, err := readPresetsFile(file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+			return err
+		}
+
+		if !recover {
+			return fmt.Errorf("presets file %s is corrupt (%w); fix it, or start with -recoverPresets to restore it from preset history or a backup", file, err)
+		}
+
+		if arr, err = recoverPresetsLocked(file, err); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range arr {
+		presets.list[p.Name] = p
+	}
+
+	if err := recordUnversionedLocked(); err != nil {
+		return err
+	}
+
+	return savePresetsLocked()
+}
+
+func readPresetsFile(file string) ([]Preset, error) {
 	b, err := os.ReadFile(file)
 	if err != nil {
-		return savePresets()
+		return nil, err
 	}
 
 	var arr []Preset
 	if err := json.Unmarshal(b, &arr); err != nil {
-		logger.Warn("Failed to parse presets file, starting empty", zap.Error(err))
-		return savePresets()
+		return nil, err
 	}
 
-	for _, p := range arr {
-		presets.list[p.Name] = p
+	return arr, nil
+}
+
+// recoverPresetsLocked moves a corrupt presets file aside and returns the presets to start
+// with instead. Callers must hold presets.mu.
+func recoverPresetsLocked(file string, cause error) ([]Preset, error) {
+	aside := file + ".corrupt-" + time.Now().Format("20060102-150405")
+	if err := os.Rename(file, aside); err != nil {
+		return nil, err
 	}
+	logger.Warn("Moved corrupt presets file aside", zap.String("path", aside), zap.Error(cause))
 
-	return nil
+	if arr := latestRevisionsLocked(); len(arr) > 0 {
+		logger.Warn("Recovered presets from preset history", zap.Int("presets", len(arr)))
+		return arr, nil
+	}
+
+	for i := 1; i <= presetBackups; i++ {
+		backup := file + ".bak." + strconv.Itoa(i)
+		arr, err := readPresetsFile(backup)
+		if err != nil {
+			continue
+		}
+
+		logger.Warn("Recovered presets from backup", zap.String("backup", backup), zap.Int("presets", len(arr)))
+		return arr, nil
+	}
+
+	logger.Warn("No preset history or usable backup found, starting with no presets")
+	return nil, nil
 }
 
+// presetBackups is how many previous versions of the presets file are kept as .bak.1 (newest)
+// to .bak.N.
+const presetBackups = 3
+
 func savePresets() error {
 	presets.mu.RLock()
 	defer presets.mu.RUnlock()
 
+	return savePresetsLocked()
+}
+
+// savePresetsLocked writes the presets file atomically after rotating backups. Callers must
+// hold presets.mu, at least for reading.
+func savePresetsLocked() error {
 	arr := make([]Preset, 0, len(presets.list))
 
 	for _, p := range presets.list {
 		arr = append(arr, p)
 	}
 
+	sort.Slice(arr, func(a, b int) bool {
+		return arr[a].Name < arr[b].Name
+	})
+
 	b, err := json.MarshalIndent(arr, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	_ = os.MkdirAll(filepath.Dir(presets.file), 0755)
+	// Concurrent saves hold the read lock together; only one may touch the files at a time.
+	presets.saveMu.Lock()
+	defer presets.saveMu.Unlock()
 
-	return os.WriteFile(presets.file, b, 0644)
+	if err := rotateBackups(presets.file, presetBackups); err != nil {
+		logger.Warn("Failed to back up presets file", zap.Error(err))
+	}
+
+	if err := writeFileAtomic(presets.file, b, 0644); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(presets.file); err == nil {
+		presets.modTime = info.ModTime()
+	}
+
+	return nil
 }
 
-func setPreset(p Preset) error {
+// setPreset validates and stores p, stamping it with the user who changed it.
+func setPreset(p *Preset, by string) error {
 	if p.Name == "" {
 		return errors.New("preset name required")
 	}
 
-	// validate steps against config programs
-	for _, s := range p.Steps {
-		if _, ok := config.Programs[s.Program]; !ok {
-			return errors.New("unknown program: " + s.Program)
-		}
+	if err := validateSteps(*p); err != nil {
+		return err
+	}
+
+	if err := checkPresetChange(*p); err != nil {
+		return err
 	}
 
+	p.UpdatedBy = by
+	p.UpdatedAt = time.Now()
+
 	presets.mu.Lock()
-	presets.list[p.Name] = p
+	p.Revision = presets.latestRevisionLocked(p.Name) + 1
+	presets.stampParentLocked(p)
+	presets.list[p.Name] = *p
+	err := presets.recordLocked(*p, presetSaved, "")
 	presets.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Preset saved", zap.String("preset", p.Name), zap.Int("revision", p.Revision), zap.String("by", by))
 
 	return savePresets()
 }
@@ -99,15 +248,108 @@ func getAllPresets() []Preset {
 		arr = append(arr, p)
 	}
 
+	sort.Slice(arr, func(a, b int) bool {
+		return arr[a].Name < arr[b].Name
+	})
+
 	return arr
 }
 
+func getPreset(name string) (Preset, bool) {
+	presets.mu.RLock()
+	defer presets.mu.RUnlock()
+
+	p, ok := presets.list[name]
+	return p, ok
+}
+
+// deletePreset removes a preset. Its history is kept, so it can be restored with a rollback.
+func deletePreset(name, by string) error {
+	if children := presetChildren(name); len(children) > 0 {
+		return presetInUseError(children)
+	}
+
+	presets.mu.Lock()
+	p, ok := presets.list[name]
+	if !ok {
+		presets.mu.Unlock()
+		return errPresetNotFound
+	}
+	delete(presets.list, name)
+
+	p.Revision = presets.latestRevisionLocked(name) + 1
+	p.UpdatedBy = by
+	p.UpdatedAt = time.Now()
+	err := presets.recordLocked(p, presetDeleted, "")
+	presets.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Preset deleted", zap.String("preset", name), zap.String("by", by))
+
+	return savePresets()
+}
+
+// renamePreset moves a preset and its history to a new name. Jobs already started keep their
+// own copy, so they are unaffected.
+func renamePreset(name, newName, by string) (Preset, error) {
+	if newName == "" {
+		return Preset{}, errors.New("new preset name required")
+	}
+
+	if children := presetChildren(name); len(children) > 0 {
+		return Preset{}, presetInUseError(children)
+	}
+
+	presets.mu.Lock()
+	p, ok := presets.list[name]
+	if !ok {
+		presets.mu.Unlock()
+		return Preset{}, errPresetNotFound
+	}
+	if newName == name {
+		presets.mu.Unlock()
+		return p, nil
+	}
+	// A deleted preset's history still claims its name.
+	if _, taken := presets.list[newName]; taken || presets.latestRevisionLocked(newName) > 0 {
+		presets.mu.Unlock()
+		return Preset{}, errPresetExists
+	}
+
+	if err := presets.renameHistoryLocked(name, newName); err != nil {
+		presets.mu.Unlock()
+		return Preset{}, err
+	}
+
+	delete(presets.list, name)
+	p.Name = newName
+	p.Revision = presets.latestRevisionLocked(newName) + 1
+	p.UpdatedBy = by
+	p.UpdatedAt = time.Now()
+	presets.list[newName] = p
+	err := presets.recordLocked(p, presetRenamed, "renamed from "+name)
+	presets.mu.Unlock()
+	if err != nil {
+		return Preset{}, err
+	}
+
+	logger.Info("Preset renamed", zap.String("preset", name), zap.String("to", newName), zap.String("by", by))
+
+	return p, savePresets()
+}
+
 func handleListPresets(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if _, ok := requireRole(w, r, roleViewer); !ok {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
 	json.NewEncoder(w).Encode(getAllPresets())
@@ -119,8 +361,8 @@ func handleCreateOrUpdatePreset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := CheckPassword(r.Header.Get("X-Password")); err != nil {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	who, ok := requireRole(w, r, rolePresetAdmin)
+	if !ok {
 		return
 	}
 
@@ -131,7 +373,7 @@ func handleCreateOrUpdatePreset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := setPreset(p); err != nil {
+	if err := setPreset(&p, who.Name); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -141,3 +383,84 @@ func handleCreateOrUpdatePreset(w http.ResponseWriter, r *http.Request) {
 
 	_ = json.NewEncoder(w).Encode(p)
 }
+
+// handlePreset returns a single preset (GET, optionally ?resolved=true), renames it (PATCH {"name": ...}) or deletes it
+// (DELETE).
+func handlePreset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := requireRole(w, r, roleViewer); !ok {
+			return
+		}
+
+		p, ok := getPreset(name)
+		if !ok {
+			http.Error(w, errPresetNotFound.Error(), http.StatusNotFound)
+			return
+		}
+
+		// ?resolved=true returns the steps a compile would run, with extends applied.
+		if r.URL.Query().Get("resolved") == "true" {
+			var err error
+			if p, err = resolvePreset(p); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p)
+
+	case http.MethodPatch:
+		who, ok := requireRole(w, r, rolePresetAdmin)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		p, err := renamePreset(name, body.Name, who.Name)
+		if err != nil {
+			http.Error(w, err.Error(), statusForPresetError(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p)
+
+	case http.MethodDelete:
+		who, ok := requireRole(w, r, rolePresetAdmin)
+		if !ok {
+			return
+		}
+
+		if err := deletePreset(name, who.Name); err != nil {
+			http.Error(w, err.Error(), statusForPresetError(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func statusForPresetError(err error) int {
+	switch {
+	case errors.Is(err, errPresetNotFound), errors.Is(err, errRevisionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errPresetExists), errors.Is(err, errPresetInUse):
+		return http.StatusConflict
+	}
+
+	return http.StatusBadRequest
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package server
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// setProcessGroup is a no-op on Windows; taskkill walks the process tree for us.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessTree kills the command and every process it spawned.
+func killProcessTree(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	if err := kill.Run(); err != nil {
+		return cmd.Process.Kill()
+	}
+
+	return nil
+}
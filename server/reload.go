@@ -0,0 +1,293 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// reloadPollInterval is how often the config and presets files are checked for changes.
+const reloadPollInterval = 2 * time.Second
+
+// Settings that are only read at startup; changing them needs a restart.
+var restartOnlySettings = []string{"dataDir", "basePath", "tlsCert", "tlsKey", "tlsSelfSigned", "tlsHosts"}
+
+// watchConfigFiles reloads the config and presets files when they change on disk or the
+// server receives SIGHUP. A file that fails to parse or validate is ignored as a whole and the
+// current settings stay in effect. Running and queued jobs keep the config they started with.
+func watchConfigFiles(configPath string, flags *configFlags) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(reloadPollInterval)
+	defer ticker.Stop()
+
+	configMod := fileModTime(configPath)
+	for {
+		force := false
+		select {
+		case <-hup:
+			logger.Info("Received SIGHUP, reloading config and presets")
+			force = true
+		case <-ticker.C:
+		}
+
+		if m := fileModTime(configPath); force || !m.Equal(configMod) {
+			configMod = m
+			if err := reloadConfig(configPath, flags); err != nil {
+				logger.Error("Config reload failed, keeping current settings", zap.Error(err))
+			}
+		}
+
+		if force || presets.changedOnDisk() {
+			if err := reloadPresets(); err != nil {
+				logger.Error("Presets reload failed, keeping current presets", zap.Error(err))
+			}
+		}
+	}
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// reloadConfig replaces the active config with the file's contents, with the same environment
+// and flag overrides applied, if it parses and every stored preset is still valid under it.
+func reloadConfig(path string, flags *configFlags) error {
+	c, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+
+	if c, err = layerConfig(c, flags); err != nil {
+		return err
+	}
+
+	for _, p := range getAllPresets() {
+		resolved, err := resolvePreset(p)
+		if err == nil {
+			err = validateResolved(c, resolved)
+		}
+		if err != nil {
+			return fmt.Errorf("preset %s: %w", p.Name, err)
+		}
+	}
+
+	running := currentConfig()
+	changes := configDiff(running, c)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	keepRestartOnly(&c, running)
+	setConfig(c)
+	for _, ch := range changes {
+		if slices.Contains(restartOnlySettings, ch.setting) {
+			logger.Warn("Config changed, takes effect after a restart", zap.String("setting", ch.setting), zap.Any("old", ch.old), zap.Any("new", ch.new))
+			continue
+		}
+		logger.Info("Config changed", zap.String("setting", ch.setting), zap.Any("old", ch.old), zap.Any("new", ch.new))
+	}
+
+	// maxConcurrentJobs may have gone up.
+	queue.redispatch()
+
+	return nil
+}
+
+// keepRestartOnly sets the restart-only settings of c back to their running values, so that
+// everything reading them through currentConfig (artifacts, workspaces) keeps agreeing with the
+// stores that were opened at startup.
+func keepRestartOnly(c *Config, running Config) {
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(running)
+	for _, f := range configFields() {
+		if slices.Contains(restartOnlySettings, f.name) {
+			dst.Field(f.index).Set(src.Field(f.index))
+		}
+	}
+}
+
+type configChange struct {
+	setting  string
+	old, new any
+}
+
+// configDiff lists the settings that differ between two configs, with map settings such as
+// programs compared per key. The password is never logged.
+func configDiff(a, b Config) []configChange {
+	am, bm := flattenConfig(a), flattenConfig(b)
+
+	var changes []configChange
+	keys := slices.Collect(maps.Keys(am))
+	for k := range bm {
+		if _, ok := am[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		av, bv := am[k], bm[k]
+		if fmt.Sprint(av) == fmt.Sprint(bv) {
+			continue
+		}
+		if k == "password" {
+			av, bv = "[redacted]", "[redacted]"
+		}
+		changes = append(changes, configChange{setting: k, old: av, new: bv})
+	}
+
+	return changes
+}
+
+func flattenConfig(c Config) map[string]any {
+	b, _ := json.Marshal(c)
+	var m map[string]any
+	_ = json.Unmarshal(b, &m)
+
+	out := map[string]any{}
+	for k, v := range m {
+		if sub, ok := v.(map[string]any); ok {
+			for sk, sv := range sub {
+				out[k+"."+sk] = sv
+			}
+			continue
+		}
+		out[k] = v
+	}
+
+	return out
+}
+
+// changedOnDisk reports whether the presets file was modified by something other than this
+// server since it was last read or written.
+func (s *presetStore) changedOnDisk() bool {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	m := fileModTime(s.file)
+	if m.Equal(s.modTime) {
+		return false
+	}
+
+	s.modTime = m
+	return true
+}
+
+// reloadPresets replaces the stored presets with the file's contents if every preset in it is
+// valid. Presets that were added, changed or removed by hand get a new revision.
+func reloadPresets() error {
+	arr, err := readPresetsFile(presets.file)
+	if err != nil {
+		return err
+	}
+
+	cfg := currentConfig()
+	byName := map[string]Preset{}
+	for _, p := range arr {
+		if p.Name == "" {
+			return errors.New("preset name required")
+		}
+		if _, dup := byName[p.Name]; dup {
+			return errors.New("duplicate preset: " + p.Name)
+		}
+		byName[p.Name] = p
+	}
+
+	lookup := func(name string) (Preset, bool) {
+		p, ok := byName[name]
+		return p, ok
+	}
+	for _, p := range arr {
+		if err := validateSteps(p); err != nil {
+			return fmt.Errorf("preset %s: %w", p.Name, err)
+		}
+
+		resolved, err := resolvePresetWith(p, lookup, map[string]bool{})
+		if err == nil {
+			err = validateResolved(cfg, resolved)
+		}
+		if err != nil {
+			return fmt.Errorf("preset %s: %w", p.Name, err)
+		}
+	}
+
+	presets.mu.Lock()
+	defer presets.mu.Unlock()
+
+	now := time.Now()
+	for _, name := range slices.Sorted(maps.Keys(byName)) {
+		p := byName[name]
+		old, existed := presets.list[name]
+		if existed && samePresetContent(old, p) {
+			byName[name] = old
+			continue
+		}
+
+		p.Revision = presets.latestRevisionLocked(name) + 1
+		p.UpdatedBy = ""
+		p.UpdatedAt = now
+		presets.stampParentLocked(&p)
+		byName[name] = p
+		if err := presets.recordLocked(p, presetSaved, "edited on disk"); err != nil {
+			return err
+		}
+
+		if existed {
+			logger.Info("Preset changed on disk", zap.String("preset", name), zap.Int("revision", p.Revision))
+		} else {
+			logger.Info("Preset added on disk", zap.String("preset", name), zap.Int("revision", p.Revision))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(presets.list)) {
+		if _, ok := byName[name]; ok {
+			continue
+		}
+
+		p := presets.list[name]
+		p.Revision = presets.latestRevisionLocked(name) + 1
+		p.UpdatedBy = ""
+		p.UpdatedAt = now
+		if err := presets.recordLocked(p, presetDeleted, "removed on disk"); err != nil {
+			return err
+		}
+
+		logger.Info("Preset removed on disk", zap.String("preset", name))
+	}
+
+	presets.list = byName
+
+	// Write back so the file carries the new revision numbers.
+	return savePresetsLocked()
+}
+
+// samePresetContent compares the parts of two presets that affect a compile.
+func samePresetContent(a, b Preset) bool {
+	content := func(p Preset) string {
+		b, _ := json.Marshal(struct {
+			Extends string
+			Profile string
+			Params  []string
+			Steps   []Step
+		}{p.Extends, p.Profile, p.Params, p.Steps})
+		return string(b)
+	}
+
+	return content(a) == content(b)
+}
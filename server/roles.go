@@ -0,0 +1,31 @@
+package server
+
+import "fmt"
+
+// Roles, from least to most privileged. Each role can do everything the ones before it can.
+const (
+	roleViewer      = "viewer"       // read presets, jobs, logs and artifacts; attach to jobs
+	roleMapper      = "mapper"       // start compiles and cancel their own jobs
+	rolePresetAdmin = "preset-admin" // create, edit and delete presets
+	roleServerAdmin = "server-admin" // manage accounts and cancel anyone's jobs
+)
+
+var roleRank = map[string]int{
+	roleViewer:      1,
+	roleMapper:      2,
+	rolePresetAdmin: 3,
+	roleServerAdmin: 4,
+}
+
+func validateRole(role string) error {
+	if _, ok := roleRank[role]; !ok {
+		return fmt.Errorf("unknown role %q (want viewer, mapper, preset-admin or server-admin)", role)
+	}
+
+	return nil
+}
+
+// can reports whether the principal's role is at least min.
+func (p principal) can(min string) bool {
+	return roleRank[p.Role] >= roleRank[min]
+}
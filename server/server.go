@@ -2,15 +2,15 @@ package server
 
 import (
 	"MapRelay/logging"
-	"bufio"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strings"
 	"sync"
 
@@ -31,23 +31,109 @@ func RunServer(args []string) {
 	port := fs.String("port", "8000", "Port to listen on")
 	configPath := fs.String("config", "server_config.json", "Path to server config JSON")
 	presetsPath := fs.String("presets", "presets.json", "Path to presets JSON store")
+	recoverPresets := fs.Bool("recoverPresets", false, "If the presets file is corrupt, move it aside and restore presets from history or a backup instead of refusing to start")
+	check := fs.Bool("check", false, "Validate the config, print a report and exit (status 1 if a check fails)")
+	checkJSON := fs.Bool("json", false, "With -check or -discoverGames, print the result as JSON")
+	printConfig := fs.Bool("printConfig", false, "Print the effective config (file, environment and flags merged) with secrets redacted, and exit")
+	configOverrides := registerConfigFlags(fs)
+	var cmd userCommand
+	cmd.register(fs)
+	var discover discoverCommand
+	discover.register(fs)
 	if err := fs.Parse(args); err != nil {
 		logger.Fatal("Failed to parse server flags", zap.Error(err))
 		return
 	}
 
-	c, err := LoadConfig(*configPath)
+	// Dry runs leave the disk alone, so they don't write a default config either.
+	loadConfig := LoadConfig
+	if *check || *printConfig {
+		loadConfig = peekConfig
+	}
+
+	c, err := loadConfig(*configPath)
+	if err == nil {
+		c, err = layerConfig(c, configOverrides)
+	}
 	if err != nil {
 		logger.Fatal("Failed to load config", zap.Error(err))
 		return
 	}
-	config = c
-	if err := initPresetStore(*presetsPath); err != nil {
+	setConfig(c)
+
+	for _, name := range unknownEnvVars() {
+		logger.Warn("Ignoring unknown environment variable", zap.String("name", name))
+	}
+
+	if *printConfig {
+		b, _ := json.MarshalIndent(redactedConfig(c), "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+
+	if *check {
+		results := checkConfig(c)
+		if _, err := os.Stat(*configPath); errors.Is(err, os.ErrNotExist) {
+			results = append([]checkResult{{Check: "config", Status: checkWarn, Detail: "not found, a default would be written to " + *configPath}}, results...)
+		}
+		if err := printCheckReport(os.Stdout, results, *checkJSON); err != nil {
+			logger.Fatal("Failed to print report", zap.Error(err))
+		}
+		if checksFailed(results) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if discover.discover {
+		if err := discover.run(*configPath, *checkJSON); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := initUserStore(c.dataDir()); err != nil {
+		logger.Fatal("Failed to init user store", zap.Error(err))
+		return
+	}
+
+	if cmd.given() {
+		if err := cmd.run(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	logCheckReport(checkConfig(c))
+
+	if err := initPresetStore(*presetsPath, c.dataDir(), *recoverPresets); err != nil {
 		logger.Fatal("Failed to init preset store", zap.Error(err))
 		return
 	}
 
+	if err := initHistoryStore(c.dataDir()); err != nil {
+		logger.Fatal("Failed to init job history store", zap.Error(err))
+		return
+	}
+
+	pruneArtifacts()
+	pruneWorkspaces()
+	go reapJobsPeriodically()
+	go watchConfigFiles(*configPath, configOverrides)
+
 	http.HandleFunc("/", handleSocket)
+	http.HandleFunc("/api/jobs", handleListJobs)
+	http.HandleFunc("/api/jobs/{id}", handleGetJob)
+	http.HandleFunc("/api/jobs/{id}/log", handleGetJobLog)
+	http.HandleFunc("/api/jobs/{id}/artifacts/{name}", handleGetArtifact)
+	http.HandleFunc("/api/admin/users", handleUsers)
+	http.HandleFunc("/api/admin/users/{name}", handleUser)
+	http.HandleFunc("/api/admin/users/{name}/tokens", handleCreateToken)
+	http.HandleFunc("/api/admin/tokens/{id}", handleRevokeToken)
+	http.HandleFunc("/api/admin/lockouts", handleLockouts)
+	http.HandleFunc("/api/admin/lockouts/{ip}", handleLockouts)
 	http.HandleFunc("/api/presets", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			handleListPresets(w, r)
@@ -55,213 +141,388 @@ func RunServer(args []string) {
 		}
 		handleCreateOrUpdatePreset(w, r)
 	})
+	http.HandleFunc("/api/presets/{name}", handlePreset)
+	http.HandleFunc("/api/presets/{name}/history", handlePresetHistory)
+	http.HandleFunc("/api/presets/{name}/rollback", handlePresetRollback)
+
+	handler := http.Handler(http.DefaultServeMux)
+	if base := c.basePath(); base != "" {
+		handler = withBasePath(base, handler)
+		logger.Info("Serving under base path " + base)
+	}
 
-	logger.Info("MapRelay server listen on port " + *port)
-	err = http.ListenAndServe(":"+*port, nil)
+	certPath, keyPath, err := c.tlsFiles()
+	if err != nil {
+		logger.Fatal("Invalid TLS config", zap.Error(err))
+		return
+	}
+	if certPath == "" {
+		logger.Info("MapRelay server listen on port " + *port)
+		err = http.ListenAndServe(":"+*port, handler)
+	} else {
+		if c.TLSSelfSigned {
+			created, err := ensureSelfSignedCert(c, certPath, keyPath)
+			if err != nil {
+				logger.Fatal("Failed to generate self-signed certificate", zap.Error(err))
+				return
+			}
+			if created {
+				logger.Info("Generated self-signed certificate", zap.String("cert", certPath), zap.String("key", keyPath))
+			}
+		}
+
+		var fp string
+		fp, err = certFingerprint(certPath, keyPath)
+		if err != nil {
+			logger.Fatal("Failed to load TLS certificate", zap.Error(err))
+			return
+		}
+
+		// Printed to stdout as well so it's easy to hand to clients for -fingerprint.
+		fmt.Println("TLS certificate SHA-256 fingerprint:", fp)
+		logger.Info("MapRelay server listen with TLS on port "+*port, zap.String("fingerprint", fp))
+		err = http.ListenAndServeTLS(":"+*port, certPath, keyPath, handler)
+	}
 	if err != nil {
 		logger.Fatal("Failed to start server", zap.Error(err))
 		return
 	}
 }
 
+// withBasePath serves h under base (e.g. "/maprelay"), so the server can sit behind a reverse
+// proxy that forwards a path prefix unchanged. Requests outside base get a 404.
+func withBasePath(base string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, base)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			http.NotFound(w, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
+
 type compileRequest struct {
-	VMF      string `json:"vmf"`
-	VMFName  string `json:"vmfName,omitempty"`
-	VMFData  []byte `json:"vmfData,omitempty"`
-	Preset   string `json:"preset"`
-	Password string `json:"password"`
+	Type    string `json:"type,omitempty"`  // "compile" (default), "attach" or "cancel"
+	JobID   string `json:"jobId,omitempty"` // job to attach to or cancel
+	VMF     string `json:"vmf"`
+	VMFName string `json:"vmfName,omitempty"`
+	// When VMFSize is set the client streams the VMF as binary frames after the server replies
+	// with "upload_ready"; VMFSha256 is checked before the compile starts.
+	VMFSize   int64  `json:"vmfSize,omitempty"`
+	VMFSha256 string `json:"vmfSha256,omitempty"`
+	Preset    string `json:"preset"`
+	// Compile with this revision of the preset instead of the current one.
+	PresetRevision int               `json:"presetRevision,omitempty"`
+	Profile        string            `json:"profile,omitempty"` // game profile, overriding the preset's
+	Params         map[string]string `json:"params,omitempty"`  // values for the preset's parameters
+	User           string            `json:"user,omitempty"`    // who started the compile, shown in the jobs API
+	Token          string            `json:"token,omitempty"`   // personal API token
+	Password       string            `json:"password"`          // shared password, used until a server-admin has a token
+}
+
+// wsConn serializes writes to a websocket from multiple goroutines.
+type wsConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *wsConn) writeJSON(v any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.WriteJSON(v)
+}
+
+func (c *wsConn) sendJSON(t, m string) {
+	_ = c.writeJSON(wsMessage{Type: t, Message: m})
 }
 
 func handleSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logger.Error("Failed to upgrade connection", zap.Error(err))
 		return
 	}
 
+	conn := &wsConn{Conn: ws}
 	defer conn.Close()
 
+	conn.SetReadLimit(maxUploadFrame)
+
 	_, msg, _ := conn.ReadMessage()
-	logger.Info("Received message", zap.String("message", string(msg)))
 
 	var req compileRequest
 	_ = json.Unmarshal(msg, &req)
 
-	if err := CheckPassword(req.Password); err != nil {
+	// Credentials may come in the request itself or on the upgrade request's headers.
+	token := req.Token
+	if token == "" {
+		token = bearerToken(r)
+	}
+
+	who, err := authenticate(clientIP(r), token, req.Password)
+	if errors.Is(err, errLockedOut) {
+		conn.sendJSON("error", "too many failed attempts, try again later")
+		return
+	}
+	if err != nil {
+		logger.Warn("Rejected socket request", zap.String("remote", r.RemoteAddr))
 		conn.WriteMessage(websocket.TextMessage, []byte("AUTH_FAILED"))
 		return
 	}
 
-	var p Preset
-	found := false
+	logger.Info("Received request", zap.String("type", req.Type), zap.String("user", who.Name), zap.String("preset", req.Preset), zap.String("job", req.JobID))
+
+	// Attaching only reads a job; compiling and cancelling change what the server is doing.
+	need := roleMapper
+	if req.Type == "attach" {
+		need = roleViewer
+	}
+
+	if !who.can(need) {
+		conn.sendJSON("error", "forbidden: requires "+need+" role")
+		return
+	}
+
+	var j *job
+	from := 0
+	switch req.Type {
+	case "attach", "cancel":
+		found, ok := jobs.get(req.JobID)
+		if !ok {
+			conn.WriteMessage(websocket.TextMessage, []byte("ERROR: job not found"))
+			return
+		}
+
+		j = found
+		if req.Type == "cancel" {
+			if !canCancel(who, j) {
+				conn.sendJSON("error", "forbidden: only the job's owner or a server-admin can cancel it")
+				return
+			}
 
-	for _, pr := range getAllPresets() {
-		if pr.Name == req.Preset {
-			p = pr
-			found = true
+			// Only follow the job until it reports its terminal status.
+			from = j.logLen()
+			if !j.requestCancel() {
+				conn.sendJSON("error", "job already finished: "+j.status())
+				return
+			}
+
+			conn.sendJSON("info", "Cancelling job "+j.id)
 			break
 		}
+
+		conn.sendJSON("info", "Attached to job "+j.id)
+	default:
+		j = startJob(conn, req, who)
+		if j == nil {
+			return
+		}
+	}
+
+	streamJob(conn, j, from, who)
+}
+
+// canCancel reports whether who may cancel j: mappers may cancel their own jobs, server-admins
+// anyone's.
+func canCancel(who principal, j *job) bool {
+	if who.can(roleServerAdmin) {
+		return true
 	}
 
+	return who.can(roleMapper) && j.record().User == who.Name
+}
+
+// startJob stores the uploaded VMF, registers a new job for it and queues it. It returns nil
+// after reporting the problem to the client if the job could not be created.
+func startJob(conn *wsConn, req compileRequest, who principal) *job {
+	p, found := getPreset(req.Preset)
+	if req.PresetRevision > 0 {
+		var err error
+		p, err = getPresetRevision(req.Preset, req.PresetRevision)
+		found = err == nil
+	}
 	if !found {
 		conn.WriteMessage(websocket.TextMessage, []byte("ERROR: preset not found"))
-		return
+		return nil
 	}
 
-	// Mutex to serialize writes to the websocket from multiple goroutines
-	var writeMu sync.Mutex
-	sendJSON := func(t, m string) {
-		writeMu.Lock()
-		defer writeMu.Unlock()
-		_ = conn.WriteJSON(wsMessage{Type: t, Message: m})
+	p, parentRevisions, err := resolveForCompile(p, req.PresetRevision > 0)
+	if err != nil {
+		conn.sendJSON("error", "Cannot resolve preset: "+err.Error())
+		return nil
 	}
 
-	// Determine VMF path: if data is provided, save to a temp location on the server
-	vmfPath := req.VMF
-	tmpDir := ""
-	if len(req.VMFData) > 0 {
-		name := req.VMFName
-		if name == "" {
-			name = "uploaded.vmf"
-		}
-		// ensure base name only
-		name = filepath.Base(name)
-		d, err := os.MkdirTemp("", "maprelay-*")
-		if err != nil {
-			sendJSON("error", "failed to create temp dir: "+err.Error())
-			return
-		}
-		tmpDir = d
-		vmfPath = filepath.Join(tmpDir, name)
-		if err := os.WriteFile(vmfPath, req.VMFData, 0644); err != nil {
-			sendJSON("error", "failed to write uploaded vmf: "+err.Error())
-			return
-		}
-		sendJSON("info", "Received VMF upload: "+vmfPath)
-		defer os.RemoveAll(tmpDir)
+	// Check the profile and parameters before accepting the upload so a typo doesn't cost a
+	// transfer.
+	profile := req.Profile
+	if profile == "" {
+		profile = p.Profile
+	}
+	cfg, err := currentConfig().forProfile(profile)
+	if err == nil {
+		err = checkPrograms(cfg, p)
+	}
+	if err != nil {
+		conn.sendJSON("error", "Cannot compile: "+err.Error())
+		return nil
 	}
 
-	vars := buildVarMap(vmfPath)
+	params, err := resolveParams(p, req.Params)
+	if err != nil {
+		conn.sendJSON("error", "Invalid parameters: "+err.Error())
+		return nil
+	}
 
-	sendJSON("info", "Starting compile...")
-	for _, step := range p.Steps {
-		progPath := config.Programs[step.Program]
-		if progPath == "" {
-			sendJSON("error", "program not configured: "+step.Program)
-			return
-		}
+	if req.VMFSize > 0 && req.VMFSha256 == "" {
+		conn.sendJSON("error", "vmfSha256 is required for uploads")
+		return nil
+	}
 
-		resolvedPath := resolveProgramPath(progPath)
-		expanded := expandArgs(step.Args, vars)
-
-		// Build command and args, with Wine wrapping on Linux for .exe
-		var cmdName string
-		var cmdArgs []string
-		useWine := runtime.GOOS == "linux" && strings.HasSuffix(strings.ToLower(resolvedPath), ".exe")
-		if useWine {
-			wine := config.WinePath
-			if wine == "" {
-				wine = "wine"
-			}
-			// Convert Unix absolute paths in arguments to Wine (Z:\\) paths so Windows tools
-			// don't treat them as relative and prepend the working directory.
-			for i, a := range expanded {
-				if len(a) > 0 && strings.HasPrefix(a, "/") {
-					// Map /foo/bar -> Z:\\foo\\bar
-					repl := strings.ReplaceAll(a, "/", "\\")
-					if strings.HasPrefix(repl, "\\") {
-						repl = repl[1:]
-					}
-					expanded[i] = "Z:\\" + repl
-				}
-			}
-			cmdName = wine
-			cmdArgs = append([]string{resolvedPath}, expanded...)
-		} else {
-			cmdName = resolvedPath
-			cmdArgs = expanded
-		}
+	// Refuse oversized uploads before asking for any data.
+	if limit := cfg.maxUploadSize(); limit > 0 && req.VMFSize > limit {
+		conn.sendJSON("error", fmt.Sprintf("VMF is %d bytes, over the server's upload limit of %d MiB", req.VMFSize, limit>>20))
+		return nil
+	}
 
-		sendJSON("info", "Running "+cmdName+" with args: "+joinArgs(cmdArgs))
+	// The VMF goes into the input dir of the job's own workspace: uploaded, or copied when the
+	// client names a file on the server's disk.
+	id := newJobID()
+	ws, err := newWorkspace(cfg, id)
+	if err != nil {
+		conn.sendJSON("error", "failed to create workspace: "+err.Error())
+		return nil
+	}
 
-		cmd := exec.Command(cmdName, cmdArgs...)
-		// Set working directory:
-		// - For Windows tools (.exe), set to the executable directory so dependent DLLs (e.g., filesystem_stdio.dll)
-		//   are found alongside the tool. This applies when running under Wine on Linux or natively on Windows.
-		// - For non-Windows binaries, keep the VMF directory so any relative paths in args resolve there.
-		workDir := vars["$path"]
-		if strings.HasSuffix(strings.ToLower(resolvedPath), ".exe") {
-			workDir = filepath.Dir(resolvedPath)
-		}
-		cmd.Dir = workDir
-		if useWine {
-			cmd.Env = append(os.Environ(), "WINEDEBUG=-all")
-		}
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			sendJSON("error", "cannot get stdout: "+err.Error())
-			return
-		}
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			sendJSON("error", "cannot get stderr: "+err.Error())
-			return
+	name := req.VMFName
+	if req.VMFSize == 0 {
+		name = req.VMF
+	}
+	if name == "" {
+		name = "uploaded.vmf"
+	}
+	// ensure base name only
+	vmfPath := filepath.Join(ws.input(), filepath.Base(name))
+
+	if req.VMFSize > 0 {
+		if err := receiveUpload(conn, vmfPath, req.VMFSize, req.VMFSha256); err != nil {
+			ws.remove()
+			conn.sendJSON("error", "failed to receive uploaded vmf: "+err.Error())
+			return nil
 		}
+		conn.sendJSON("info", "Received VMF upload: "+vmfPath)
+	} else if err := copyFile(req.VMF, vmfPath); err != nil {
+		ws.remove()
+		conn.sendJSON("error", "cannot read vmf: "+err.Error())
+		return nil
+	}
 
-		if err := cmd.Start(); err != nil {
-			sendJSON("error", "failed to start: "+err.Error())
-			return
+	// Jobs belong to the authenticated user. Without accounts we can only go by the name the
+	// client reports.
+	owner := who.Name
+	if owner == sharedUser && req.User != "" {
+		owner = req.User
+	}
+
+	j := newJob(id, p, vmfPath, ws, owner)
+	j.cfg = cfg
+	j.rec.Profile = cfg.profileName
+	if len(parentRevisions) > 0 {
+		j.rec.ExtendsRevisions = parentRevisions
+	}
+	j.params = params
+	j.rec.Params = params
+	j.rec.VMFHash = req.VMFSha256
+	if j.rec.VMFHash == "" {
+		if sum, err := hashFile(vmfPath); err == nil {
+			j.rec.VMFHash = sum
 		}
+	}
+	if err := j.openLog(history.logPath(j.id)); err != nil {
+		logger.Warn("Failed to create job log file", zap.String("job", j.id), zap.Error(err))
+	}
+	jobs.add(j)
+	conn.sendJSON("job", j.id)
+	logger.Info("Created compile job", zap.String("job", j.id), zap.String("preset", p.Name))
+
+	queue.submit(j)
+	return j
+}
 
-		// Stream output
-		var wg sync.WaitGroup
-		wg.Add(2)
-		go func() {
-			defer wg.Done()
-			scan := bufio.NewScanner(stdout)
-			for scan.Scan() {
-				sendJSON(step.Program, scan.Text())
+// streamJob replays the job's buffered output from index from onwards and follows it until the
+// job finishes or the client goes away. A disconnecting client does not affect the job itself,
+// but the client may send a cancel message while attached.
+func streamJob(conn *wsConn, j *job, from int, who principal) {
+	// Keep reading so control frames are handled and we notice when the client disconnects.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
 			}
-		}()
-		go func() {
-			defer wg.Done()
-			scan := bufio.NewScanner(stderr)
-			for scan.Scan() {
-				sendJSON(step.Program, scan.Text())
+
+			var m compileRequest
+			if json.Unmarshal(msg, &m) == nil && m.Type == "cancel" {
+				if !canCancel(who, j) {
+					conn.sendJSON("error", "forbidden: only the job's owner or a server-admin can cancel it")
+					continue
+				}
+
+				logger.Info("Client cancelled job", zap.String("job", j.id), zap.String("user", who.Name))
+				j.requestCancel()
 			}
-		}()
+		}
+	}()
+
+	next := from
+	for {
+		msgs, wait := j.since(next)
+		for _, m := range msgs {
+			if err := conn.writeJSON(m); err != nil {
+				logger.Info("Client detached from job", zap.String("job", j.id))
+				return
+			}
+		}
+		next += len(msgs)
 
-		wg.Wait()
+		if wait == nil {
+			break
+		}
 
-		if err := cmd.Wait(); err != nil {
-			sendJSON("error", "process exited with error: "+err.Error())
+		select {
+		case <-wait:
+		case <-gone:
+			logger.Info("Client detached from job", zap.String("job", j.id))
 			return
 		}
+	}
 
-		sendJSON("step_done", step.Program)
+	if j.status() != jobSucceeded {
+		return
 	}
 
-	// After successful compile, send the compiled BSP back to the client
-	bspPath := vars["$bsp"]
-	if bspPath != "" {
-		if b, err := os.ReadFile(bspPath); err == nil {
-			// send typed message with base64 payload
-			type bspMsg struct {
-				Type string `json:"type"`
-				Name string `json:"name"`
-				Data string `json:"data"`
-			}
-			encoded := base64.StdEncoding.EncodeToString(b)
-			writeMu.Lock()
-			_ = conn.WriteJSON(bspMsg{Type: "bsp", Name: filepath.Base(bspPath), Data: encoded})
-			writeMu.Unlock()
-		} else {
-			sendJSON("error", "failed to read bsp: "+err.Error())
+	// After successful compile, stream the compiled BSP back to the client
+	if rec := j.record(); rec.ArtifactPath != "" {
+		if err := sendArtifact(conn, rec.ArtifactPath, rec.ArtifactSHA256); err != nil {
+			conn.sendJSON("error", "failed to send bsp: "+err.Error())
 			return
 		}
 	}
 
-	sendJSON("done", "")
+	conn.sendJSON("done", "")
 }
 
 func joinArgs(a []string) string {
@@ -272,7 +533,9 @@ func joinArgs(a []string) string {
 	return string(b)
 }
 
-func buildVarMap(vmf string) map[string]string {
+// buildVarMap returns the built-in variables for compiling vmf, which lives in the work dir of
+// ws. Everything the tools write goes there or into the workspace's other dirs.
+func buildVarMap(cfg Config, ws workspace, vmf string) map[string]string {
 	vars := map[string]string{}
 	abs := vmf
 	if a, err := filepath.Abs(vmf); err == nil {
@@ -287,34 +550,25 @@ func buildVarMap(vmf string) map[string]string {
 		name = base[:dot]
 	}
 
-	tmp := os.TempDir()
-
 	// Resolve gameDir: allow short folder names like "garrysmod" or "hl2" relative to BaseGamePath
-	gameDir := config.GameDir
-	if gameDir != "" && !filepath.IsAbs(gameDir) && config.BaseGamePath != "" {
-		gameDir = filepath.Join(config.BaseGamePath, gameDir)
-	}
+	gameDir := cfg.gameDir()
 
-	// BSP output directory must match the VMF directory. We intentionally ignore any configured BspDir
-	// because VBSP should output next to the VMF, and subsequent tools (VVIS/VRAD) must reference that.
+	// VBSP writes the BSP next to the VMF and VVIS/VRAD must reference it there, so the BSP is
+	// built in the work dir. A configured BspDir gets a copy once the job succeeds.
 	bspDir := dir
 
-	exeDir := config.ExeDir
+	exeDir := cfg.ExeDir
 	if exeDir == "" {
 		exeDir = ""
 	}
 
-	if config.TmpDir != "" {
-		tmp = config.TmpDir
-	}
-
 	bsp := filepath.Join(bspDir, name+".bsp")
 
 	vars["$path"] = dir
 	vars["$mapdir"] = dir
 	vars["$file"] = name
 	vars["$name"] = name
-	vars["$tmp"] = tmp
+	vars["$tmp"] = ws.work()
 	vars["$gamedir"] = gameDir
 	vars["$game"] = gameDir
 	vars["$bspdir"] = bspDir
@@ -322,13 +576,21 @@ func buildVarMap(vmf string) map[string]string {
 	vars["$exedir"] = exeDir
 	// Full VMF absolute path
 	vars["$vmf"] = abs
+	vars["$workspace"] = ws.root
+	vars["$indir"] = ws.input()
+	vars["$outdir"] = ws.output()
+	vars["$logdir"] = ws.logs()
 	return vars
 }
 
 func expandArgs(args []string, vars map[string]string) []string {
-	out := make([]string, len(args))
-	for i, a := range args {
-		out[i] = expandString(a, vars)
+	out := make([]string, 0, len(args))
+	for _, a := range args {
+		a, keep := conditionalArg(a, vars)
+		if !keep {
+			continue
+		}
+		out = append(out, expandString(a, vars))
 	}
 	return out
 }
@@ -338,23 +600,24 @@ func expandString(s string, vars map[string]string) string {
 		return s
 	}
 
-	// Replace longer keys first to avoid partial overlaps (e.g., $game vs $gamedir)
-	order := []string{"$gamedir", "$bspdir", "$mapdir", "$exedir", "$vmf", "$file", "$name", "$path", "$tmp", "$bsp", "$game"}
-	res := s
-	seen := map[string]bool{}
-	for _, k := range order {
-		if v, ok := vars[k]; ok {
-			seen[k] = true
-			res = strings.ReplaceAll(res, k, v)
-		}
+	// Match longer keys first to avoid partial overlaps (e.g., $game vs $gamedir, or a
+	// $bounces parameter vs $bounce). A single pass also keeps values from being re-expanded.
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
 	}
-
-	for k, v := range vars {
-		if !seen[k] {
-			res = strings.ReplaceAll(res, k, v)
+	sort.Slice(keys, func(a, b int) bool {
+		if len(keys[a]) != len(keys[b]) {
+			return len(keys[a]) > len(keys[b])
 		}
+		return keys[a] < keys[b]
+	})
+
+	pairs := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k, vars[k])
 	}
-	return res
+	return strings.NewReplacer(pairs...).Replace(s)
 }
 
 // resolveProgramPath resolves a configured program path against BaseGamePath when needed.
@@ -362,10 +625,11 @@ func expandString(s string, vars map[string]string) string {
 // - If path is absolute and exists, return it.
 // - If BaseGamePath is set:
 //   - If path is not absolute, join BaseGamePath with it.
-//   - If path is absolute but does not exist, try joining BaseGamePath with the trimmed leading separators.
+//   - If path is absolute but does not exist, try joining BaseGamePath with the trimmed leading separators,
+//     unless it is already under BaseGamePath.
 //
 // - Otherwise, return the original path.
-func resolveProgramPath(p string) string {
+func resolveProgramPath(cfg Config, p string) string {
 	if p == "" {
 		return p
 	}
@@ -377,7 +641,7 @@ func resolveProgramPath(p string) string {
 			return norm
 		}
 	}
-	base := config.BaseGamePath
+	base := cfg.BaseGamePath
 	if base == "" {
 		return norm
 	}
@@ -385,7 +649,11 @@ func resolveProgramPath(p string) string {
 	if !filepath.IsAbs(norm) {
 		return filepath.Join(base, norm)
 	}
-	// Absolute but missing; treat as relative-to-base with trimmed leading separators
+	// Absolute but missing. Paths already under base (such as the derived defaults) stay as they
+	// are; anything else is treated as relative-to-base with trimmed leading separators
+	if strings.HasPrefix(norm, strings.ReplaceAll(base, "\\", "/")+"/") {
+		return norm
+	}
 	trimmed := strings.TrimLeft(norm, "/\\")
 	return filepath.Join(base, trimmed)
 }
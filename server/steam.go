@@ -0,0 +1,279 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// steamGame is a Source game found in a Steam library.
+type steamGame struct {
+	AppID       string            `json:"appId"`
+	Name        string            `json:"name"`
+	InstallPath string            `json:"installPath"`
+	GameDir     string            `json:"gamedir"`            // the game's content folder, e.g. "garrysmod"
+	GameDirs    []string          `json:"gameDirs,omitempty"` // every folder with a gameinfo.txt
+	BinDir      string            `json:"binDir,omitempty"`   // folder with the compile tools, if shipped
+	Programs    map[string]string `json:"programs,omitempty"`
+}
+
+// Content folders of well-known games whose installs contain more than one gameinfo.txt.
+var knownGameDirs = map[string]string{
+	"220":  "hl2",
+	"240":  "cstrike",
+	"300":  "dod",
+	"320":  "hl2mp",
+	"440":  "tf",
+	"550":  "left4dead2",
+	"620":  "portal2",
+	"730":  "csgo",
+	"4000": "garrysmod",
+}
+
+// Where the compile tools live relative to a game's install, most specific first.
+var steamBinDirs = []string{"bin/win64", "bin/x64", "bin"}
+
+// steamRoots returns the usual Steam install locations for this platform.
+func steamRoots() []string {
+	home, _ := os.UserHomeDir()
+
+	switch runtime.GOOS {
+	case "windows":
+		var roots []string
+		for _, env := range []string{"ProgramFiles(x86)", "ProgramFiles"} {
+			if dir := os.Getenv(env); dir != "" {
+				roots = append(roots, filepath.Join(dir, "Steam"))
+			}
+		}
+		return append(roots, "C:/Program Files (x86)/Steam")
+	case "darwin":
+		return []string{filepath.Join(home, "Library/Application Support/Steam")}
+	}
+
+	return []string{
+		filepath.Join(home, ".local/share/Steam"),
+		filepath.Join(home, ".steam/steam"),
+		filepath.Join(home, ".steam/root"),
+		filepath.Join(home, ".var/app/com.valvesoftware.Steam/.local/share/Steam"), // Flatpak
+	}
+}
+
+// steamLibraries lists the library folders of the Steam install at root, including root itself.
+func steamLibraries(root string) ([]string, error) {
+	libs := []string{root}
+
+	f, err := os.Open(filepath.Join(root, "steamapps", "libraryfolders.vdf"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return libs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	doc, err := parseVDF(f)
+	if err != nil {
+		return nil, errors.New(f.Name() + ": " + err.Error())
+	}
+
+	folders := doc.obj("libraryfolders")
+	if folders == nil {
+		return libs, nil
+	}
+
+	for _, key := range folders.keys {
+		// Libraries are numbered; older files also have a few settings next to them.
+		if _, err := strconv.Atoi(key); err != nil {
+			continue
+		}
+
+		// Current files have an object per library; older ones just the path.
+		path := folders.str(key)
+		if lib := folders.obj(key); lib != nil {
+			path = lib.str("path")
+		}
+		if path == "" {
+			continue
+		}
+		libs = append(libs, path)
+	}
+
+	return libs, nil
+}
+
+// discoverSteamGames finds the Source games installed in the Steam libraries under roots,
+// or under the usual Steam locations if roots is empty. Duplicate libraries (e.g. through the
+// ~/.steam symlinks) are only scanned once.
+func discoverSteamGames(roots []string) ([]steamGame, error) {
+	if len(roots) == 0 {
+		roots = steamRoots()
+	}
+
+	seen := map[string]bool{}
+	var games []steamGame
+	for _, root := range roots {
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			continue
+		}
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+
+		libs, err := steamLibraries(root)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, lib := range libs {
+			real, err := filepath.EvalSymlinks(lib)
+			if err != nil || seen[real] {
+				continue
+			}
+			seen[real] = true
+
+			found, err := libraryGames(lib)
+			if err != nil {
+				return nil, err
+			}
+			games = append(games, found...)
+		}
+	}
+
+	slices.SortFunc(games, func(a, b steamGame) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+
+	return games, nil
+}
+
+// libraryGames reads the app manifests of one Steam library and returns the installed apps
+// that look like Source games, i.e. have a gameinfo.txt one level below their install folder.
+func libraryGames(lib string) ([]steamGame, error) {
+	manifests, err := filepath.Glob(filepath.Join(lib, "steamapps", "appmanifest_*.acf"))
+	if err != nil {
+		return nil, err
+	}
+
+	var games []steamGame
+	for _, m := range manifests {
+		f, err := os.Open(m)
+		if err != nil {
+			continue
+		}
+		doc, err := parseVDF(f)
+		f.Close()
+		if err != nil {
+			logger.Warn("Skipping unreadable app manifest", zap.String("path", m), zap.Error(err))
+			continue
+		}
+
+		app := doc.obj("AppState")
+		if app == nil || app.str("installdir") == "" {
+			continue
+		}
+
+		g := steamGame{
+			AppID:       app.str("appid"),
+			Name:        app.str("name"),
+			InstallPath: filepath.Join(lib, "steamapps", "common", app.str("installdir")),
+		}
+
+		g.GameDirs = gameInfoDirs(g.InstallPath)
+		if len(g.GameDirs) == 0 {
+			continue
+		}
+		g.GameDir = primaryGameDir(g.AppID, g.GameDirs)
+		g.BinDir, g.Programs = compileTools(g.InstallPath)
+
+		games = append(games, g)
+	}
+
+	return games, nil
+}
+
+func gameInfoDirs(install string) []string {
+	entries, err := os.ReadDir(install)
+	if err != nil {
+		return nil
+	}
+
+	var dirs []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(install, e.Name(), "gameinfo.txt")); err == nil {
+			dirs = append(dirs, e.Name())
+		}
+	}
+
+	return dirs
+}
+
+func primaryGameDir(appID string, dirs []string) string {
+	if known, ok := knownGameDirs[appID]; ok && slices.Contains(dirs, known) {
+		return known
+	}
+
+	// Mods built on Source SDK Base usually ship hl2 alongside their own folder.
+	for _, d := range dirs {
+		if d != "hl2" {
+			return d
+		}
+	}
+
+	return dirs[0]
+}
+
+// compileTools finds vbsp, vvis and vrad in the first bin folder of install that has vbsp.
+// vvis++ is preferred over vvis where it ships.
+func compileTools(install string) (string, map[string]string) {
+	exe := func(dir, name string) string {
+		for _, file := range []string{name + ".exe", name} {
+			p := filepath.Join(dir, file)
+			if info, err := os.Stat(p); err == nil && !info.IsDir() {
+				return filepath.ToSlash(p)
+			}
+		}
+		return ""
+	}
+
+	for _, rel := range steamBinDirs {
+		dir := filepath.Join(install, rel)
+		vbsp := exe(dir, "vbsp")
+		if vbsp == "" {
+			continue
+		}
+
+		programs := map[string]string{"vbsp": vbsp}
+		if vvis := exe(dir, "vvisplusplus"); vvis != "" {
+			programs["vvis"] = vvis
+		} else if vvis := exe(dir, "vvis"); vvis != "" {
+			programs["vvis"] = vvis
+		}
+		if vrad := exe(dir, "vrad"); vrad != "" {
+			programs["vrad"] = vrad
+		}
+
+		return filepath.ToSlash(dir), programs
+	}
+
+	return "", nil
+}
+
+// profile describes g as a game profile with its compile tools spelled out, since they may not
+// be where deriveDefaultPrograms expects them.
+func (g steamGame) profile() GameProfile {
+	return GameProfile{
+		BaseGamePath: filepath.ToSlash(g.InstallPath),
+		GameDir:      g.GameDir,
+		Programs:     g.Programs,
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tlsFiles returns the certificate and key paths to serve with, or empty strings when TLS is
+// disabled. Self-signed mode defaults both paths into <dataDir>/tls. A certificate without a
+// key (or the reverse) is an error rather than a silent fallback to plain HTTP.
+func (c Config) tlsFiles() (string, string, error) {
+	cert, key := c.TLSCert, c.TLSKey
+	if c.TLSSelfSigned {
+		if cert == "" {
+			cert = filepath.Join(c.dataDir(), "tls", "cert.pem")
+		}
+		if key == "" {
+			key = filepath.Join(c.dataDir(), "tls", "key.pem")
+		}
+	}
+
+	switch {
+	case cert == "" && key == "":
+		return "", "", nil
+	case cert == "":
+		return "", "", errors.New("tlsKey is set but tlsCert isn't")
+	case key == "":
+		return "", "", errors.New("tlsCert is set but tlsKey isn't")
+	}
+
+	return cert, key, nil
+}
+
+// ensureSelfSignedCert generates a self-signed certificate at certPath/keyPath unless both
+// already exist. It covers localhost, this machine's hostname and c.TLSHosts. If only one of
+// the files exists it refuses, rather than overwrite a certificate or key someone may need.
+func ensureSelfSignedCert(c Config, certPath, keyPath string) (bool, error) {
+	if err := selfSignedMissing(certPath, keyPath); err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(certPath); err == nil {
+		return false, nil
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return false, err
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "MapRelay"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	hosts := append([]string{"localhost", "127.0.0.1", "::1"}, c.TLSHosts...)
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return false, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return false, err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return false, err
+	}
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// selfSignedMissing checks that the certificate and key either both exist or both don't.
+func selfSignedMissing(certPath, keyPath string) error {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	for _, err := range []error{certErr, keyErr} {
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	switch {
+	case certErr == nil && keyErr != nil:
+		return errors.New(certPath + " exists but " + keyPath + " doesn't; restore the key or remove the certificate to generate a new pair")
+	case certErr != nil && keyErr == nil:
+		return errors.New(keyPath + " exists but " + certPath + " doesn't; restore the certificate or remove the key to generate a new pair")
+	}
+
+	return nil
+}
+
+// certFingerprint returns the SHA-256 fingerprint of the certificate, in the colon-separated
+// hex form clients pass to -fingerprint.
+func certFingerprint(certPath, keyPath string) (string, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(pair.Certificate[0])
+	return formatFingerprint(sum[:]), nil
+}
+
+func formatFingerprint(b []byte) string {
+	parts := make([]string, len(b))
+	for i, v := range b {
+		parts[i] = strings.ToUpper(hex.EncodeToString([]byte{v}))
+	}
+
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gorilla/websocket"
+)
+
+// Uploads are streamed as binary WebSocket frames of at most this size. It is also the read
+// limit for every frame on the compile socket.
+const maxUploadFrame = 4 << 20
+
+// receiveUpload reads binary frames from conn into path until size bytes have arrived, then
+// checks them against the SHA-256 the client declared up front. The partial file is removed
+// on any error.
+func receiveUpload(conn *wsConn, path string, size int64, sum string) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+
+	conn.sendJSON("upload_ready", "")
+
+	h := sha256.New()
+	var received int64
+	for received < size {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("upload interrupted after %d of %d bytes: %w", received, size, err)
+		}
+
+		if mt != websocket.BinaryMessage {
+			return errors.New("unexpected text frame during upload")
+		}
+
+		if received+int64(len(data)) > size {
+			return fmt.Errorf("upload exceeds declared size of %d bytes", size)
+		}
+
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+
+		h.Write(data)
+		received += int64(len(data))
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return fmt.Errorf("checksum mismatch: declared %s, received %s", sum, got)
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// apiToken is a per-user credential. Only a SHA-256 of the token is stored; the plaintext is
+// shown once when the token is created.
+type apiToken struct {
+	ID      string    `json:"id"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+type User struct {
+	Name    string     `json:"name"`
+	Role    string     `json:"role"`
+	Created time.Time  `json:"created"`
+	Tokens  []apiToken `json:"tokens"`
+}
+
+// userStore keeps accounts in <dataDir>/users.json. The file is re-read whenever it changes on
+// disk, so `-server -createUser` and friends take effect on a running server.
+type userStore struct {
+	file    string
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]*User
+}
+
+var users userStore
+
+var (
+	errUserExists   = errors.New("user already exists")
+	errUserNotFound = errors.New("user not found")
+	errTokenUnknown = errors.New("token not found")
+)
+
+func initUserStore(dataDir string) error {
+	users = userStore{file: filepath.Join(dataDir, "users.json"), users: map[string]*User{}}
+
+	users.mu.Lock()
+	defer users.mu.Unlock()
+
+	return users.refreshLocked()
+}
+
+// refreshLocked reloads the store if the file changed since it was last read.
+func (s *userStore) refreshLocked() error {
+	info, err := os.Stat(s.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+
+	var arr []*User
+	if err := json.Unmarshal(b, &arr); err != nil {
+		return err
+	}
+
+	s.users = map[string]*User{}
+	for _, u := range arr {
+		s.users[u.Name] = u
+	}
+	s.modTime = info.ModTime()
+
+	return nil
+}
+
+func (s *userStore) saveLocked() error {
+	arr := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		arr = append(arr, u)
+	}
+
+	sort.Slice(arr, func(a, b int) bool {
+		return arr[a].Name < arr[b].Name
+	})
+
+	b, err := json.MarshalIndent(arr, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Tokens are hashed, but the file still says who may do what, so keep it private.
+	if err := writeFileAtomic(s.file, b, 0600); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(s.file); err == nil {
+		s.modTime = info.ModTime()
+	}
+
+	return nil
+}
+
+// hasAdminToken reports whether some server-admin holds a token. Until then the server falls
+// back to the shared password (or no authentication at all), so creating accounts over the API
+// can't lock the admin out before they have a token to use.
+func (s *userStore) hasAdminToken() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refreshLocked(); err != nil {
+		logger.Error("Failed to reload users", zap.Error(err))
+	}
+
+	for _, u := range s.users {
+		if u.Role == roleServerAdmin && len(u.Tokens) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *userStore) create(name, role string) (User, error) {
+	if name == "" {
+		return User{}, errors.New("user name required")
+	}
+
+	if err := validateRole(role); err != nil {
+		return User{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refreshLocked(); err != nil {
+		return User{}, err
+	}
+
+	if _, ok := s.users[name]; ok {
+		return User{}, errUserExists
+	}
+
+	u := &User{Name: name, Role: role, Created: time.Now(), Tokens: []apiToken{}}
+	s.users[name] = u
+
+	return *u, s.saveLocked()
+}
+
+func (s *userStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refreshLocked(); err != nil {
+		return err
+	}
+
+	if _, ok := s.users[name]; !ok {
+		return errUserNotFound
+	}
+
+	delete(s.users, name)
+	return s.saveLocked()
+}
+
+func (s *userStore) setRole(name, role string) error {
+	if err := validateRole(role); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refreshLocked(); err != nil {
+		return err
+	}
+
+	u, ok := s.users[name]
+	if !ok {
+		return errUserNotFound
+	}
+
+	u.Role = role
+	return s.saveLocked()
+}
+
+// list returns copies of all users with token hashes stripped.
+func (s *userStore) list() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refreshLocked(); err != nil {
+		return nil, err
+	}
+
+	arr := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		c := *u
+		c.Tokens = make([]apiToken, len(u.Tokens))
+		for i, t := range u.Tokens {
+			c.Tokens[i] = apiToken{ID: t.ID, Created: t.Created}
+		}
+		arr = append(arr, c)
+	}
+
+	sort.Slice(arr, func(a, b int) bool {
+		return arr[a].Name < arr[b].Name
+	})
+
+	return arr, nil
+}
+
+// issueToken creates a new token for the user and returns its ID and plaintext value.
+func (s *userStore) issueToken(name string) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refreshLocked(); err != nil {
+		return "", "", err
+	}
+
+	u, ok := s.users[name]
+	if !ok {
+		return "", "", errUserNotFound
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	token := "mr_" + hex.EncodeToString(secret)
+	id := newJobID()[:8]
+	u.Tokens = append(u.Tokens, apiToken{ID: id, Hash: hashToken(token), Created: time.Now()})
+
+	return id, token, s.saveLocked()
+}
+
+func (s *userStore) revokeToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refreshLocked(); err != nil {
+		return err
+	}
+
+	for _, u := range s.users {
+		for i, t := range u.Tokens {
+			if t.ID == id {
+				u.Tokens = append(u.Tokens[:i], u.Tokens[i+1:]...)
+				return s.saveLocked()
+			}
+		}
+	}
+
+	return errTokenUnknown
+}
+
+// lookupToken returns the user owning the token.
+func (s *userStore) lookupToken(token string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refreshLocked(); err != nil {
+		logger.Error("Failed to reload users", zap.Error(err))
+		return User{}, false
+	}
+
+	// Compare against every token in constant time so timing reveals nothing about how close
+	// a guess was.
+	h := []byte(hashToken(token))
+	var found *User
+	for _, u := range s.users {
+		for _, t := range u.Tokens {
+			if subtle.ConstantTimeCompare(h, []byte(t.Hash)) == 1 {
+				found = u
+			}
+		}
+	}
+
+	if found == nil {
+		return User{}, false
+	}
+
+	return *found, true
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// userCommand holds the account management flags of `-server`. When any of them is given the
+// server performs that one action against the user store and exits instead of listening.
+type userCommand struct {
+	createUser  string
+	role        string
+	setRole     string
+	deleteUser  string
+	createToken string
+	revokeToken string
+	listUsers   bool
+}
+
+func (c *userCommand) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.createUser, "createUser", "", "Create a user account and exit")
+	fs.StringVar(&c.role, "role", roleMapper, "Role for -createUser and -setRole: viewer, mapper, preset-admin or server-admin")
+	fs.StringVar(&c.setRole, "setRole", "", "Change the named user's role to -role and exit")
+	fs.StringVar(&c.deleteUser, "deleteUser", "", "Delete a user account and its tokens, then exit")
+	fs.StringVar(&c.createToken, "createToken", "", "Issue an API token for the named user, print it and exit")
+	fs.StringVar(&c.revokeToken, "revokeToken", "", "Revoke the API token with this ID and exit")
+	fs.BoolVar(&c.listUsers, "listUsers", false, "List user accounts and token IDs, then exit")
+}
+
+func (c *userCommand) given() bool {
+	return c.createUser != "" || c.setRole != "" || c.deleteUser != "" || c.createToken != "" || c.revokeToken != "" || c.listUsers
+}
+
+func (c *userCommand) run() error {
+	switch {
+	case c.createUser != "":
+		if _, err := users.create(c.createUser, c.role); err != nil {
+			return err
+		}
+		fmt.Println("Created user", c.createUser, "with role", c.role)
+	case c.setRole != "":
+		if err := users.setRole(c.setRole, c.role); err != nil {
+			return err
+		}
+		fmt.Println("Set role of", c.setRole, "to", c.role)
+	case c.deleteUser != "":
+		if err := users.remove(c.deleteUser); err != nil {
+			return err
+		}
+		fmt.Println("Deleted user", c.deleteUser)
+	case c.createToken != "":
+		id, token, err := users.issueToken(c.createToken)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Token %s for %s (shown once, store it now):\n%s\n", id, c.createToken, token)
+	case c.revokeToken != "":
+		if err := users.revokeToken(c.revokeToken); err != nil {
+			return err
+		}
+		fmt.Println("Revoked token", c.revokeToken)
+	case c.listUsers:
+		arr, err := users.list()
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "USER\tROLE\tTOKENS")
+		for _, u := range arr {
+			ids := ""
+			for i, t := range u.Tokens {
+				if i > 0 {
+					ids += ","
+				}
+				ids += t.ID
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", u.Name, u.Role, ids)
+		}
+		return tw.Flush()
+	}
+
+	return nil
+}
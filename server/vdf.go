@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// vdfNode is a parsed Valve KeyValues (VDF/ACF) object. Values are either strings or nested
+// *vdfNode objects. Keys are stored lower-cased because Steam isn't consistent about case
+// ("LibraryFolders" in old files, "libraryfolders" in new ones).
+type vdfNode struct {
+	keys   []string
+	values map[string]any
+}
+
+// str returns the string value of key, or "" if it is missing or an object.
+func (n *vdfNode) str(key string) string {
+	s, _ := n.values[strings.ToLower(key)].(string)
+	return s
+}
+
+// obj returns the object value of key, or nil if it is missing or a string.
+func (n *vdfNode) obj(key string) *vdfNode {
+	o, _ := n.values[strings.ToLower(key)].(*vdfNode)
+	return o
+}
+
+// parseVDF reads a KeyValues document such as libraryfolders.vdf or an appmanifest .acf file.
+func parseVDF(r io.Reader) (*vdfNode, error) {
+	p := &vdfParser{r: bufio.NewReader(r)}
+
+	root, err := p.object(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
+
+type vdfParser struct {
+	r *bufio.Reader
+}
+
+func (p *vdfParser) object(nested bool) (*vdfNode, error) {
+	n := &vdfNode{values: map[string]any{}}
+	for {
+		tok, quoted, err := p.token()
+		if errors.Is(err, io.EOF) {
+			if nested {
+				return nil, errors.New("vdf: unexpected end of file")
+			}
+			return n, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !quoted && tok == "}" {
+			if !nested {
+				return nil, errors.New("vdf: unexpected }")
+			}
+			return n, nil
+		}
+		if !quoted && tok == "{" {
+			return nil, errors.New("vdf: object without a key")
+		}
+
+		val, valQuoted, err := p.token()
+		if err != nil {
+			return nil, errors.New("vdf: missing value for " + tok)
+		}
+
+		var v any = val
+		if !valQuoted && val == "{" {
+			if v, err = p.object(true); err != nil {
+				return nil, err
+			}
+		}
+
+		key := strings.ToLower(tok)
+		if _, dup := n.values[key]; !dup {
+			n.keys = append(n.keys, key)
+		}
+		n.values[key] = v
+	}
+}
+
+// token returns the next string, brace or bare word, skipping whitespace, // comments and
+// platform conditionals such as [$WIN32].
+func (p *vdfParser) token() (string, bool, error) {
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return "", false, err
+		}
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			continue
+		case c == '/':
+			if next, _ := p.r.Peek(1); len(next) == 1 && next[0] == '/' {
+				if _, err := p.r.ReadString('\n'); err != nil && !errors.Is(err, io.EOF) {
+					return "", false, err
+				}
+				continue
+			}
+		case c == '[':
+			if _, err := p.r.ReadString(']'); err != nil {
+				return "", false, err
+			}
+			continue
+		case c == '{' || c == '}':
+			return string(c), false, nil
+		case c == '"':
+			s, err := p.quoted()
+			return s, true, err
+		}
+
+		var b strings.Builder
+		b.WriteByte(c)
+		for {
+			next, err := p.r.Peek(1)
+			if err != nil || strings.ContainsRune(" \t\r\n{}\"", rune(next[0])) {
+				return b.String(), false, nil
+			}
+			b.WriteByte(next[0])
+			p.r.ReadByte()
+		}
+	}
+}
+
+func (p *vdfParser) quoted() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return "", errors.New("vdf: unterminated string")
+		}
+
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			e, err := p.r.ReadByte()
+			if err != nil {
+				return "", errors.New("vdf: unterminated string")
+			}
+			switch e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
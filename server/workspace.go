@@ -0,0 +1,204 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Workspace cleanup policies, applied when a job finishes.
+const (
+	cleanupAlways    = "always"    // remove every workspace
+	cleanupOnSuccess = "onSuccess" // keep the workspaces of failed and cancelled jobs
+	cleanupNever     = "never"     // keep every workspace until workspaceRetention expires
+)
+
+const defaultWorkspaceRetention = 24 * time.Hour
+
+// workspaceMarker is written into every workspace, so pruneWorkspaces never touches directories
+// it didn't create when workspaceRoot is shared with something else.
+const workspaceMarker = ".maprelay-workspace"
+
+// workspace is a job's private directory tree, <workspaceRoot>/<jobID>/:
+//
+//	input/   the VMF as uploaded (or copied from the server's disk), never modified
+//	work/    a copy of the VMF that the tools run on, and everything they write next to it
+//	output/  the compiled BSP and anything else a preset writes to $outdir
+//	logs/    the tools' own .log files, collected when the job finishes
+//
+// Workspaces are keyed by job ID, so jobs compiling maps with the same name never share files.
+type workspace struct {
+	root string
+}
+
+func (w workspace) input() string  { return filepath.Join(w.root, "input") }
+func (w workspace) work() string   { return filepath.Join(w.root, "work") }
+func (w workspace) output() string { return filepath.Join(w.root, "output") }
+func (w workspace) logs() string   { return filepath.Join(w.root, "logs") }
+
+// newWorkspace creates the workspace for job id under the configured root. Its path is
+// absolute, since it ends up in tool arguments that may be run from another directory.
+func newWorkspace(c Config, id string) (workspace, error) {
+	root, err := filepath.Abs(filepath.Join(c.workspaceRoot(), id))
+	if err != nil {
+		return workspace{}, err
+	}
+
+	w := workspace{root: root}
+	for _, dir := range []string{w.input(), w.work(), w.output(), w.logs()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return workspace{}, err
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(root, workspaceMarker), []byte(id+"\n"), 0644); err != nil {
+		return workspace{}, err
+	}
+
+	return w, nil
+}
+
+// prepare copies the input VMF into work/ and returns the copy's path.
+func (w workspace) prepare(vmf string) (string, error) {
+	dst := filepath.Join(w.work(), filepath.Base(vmf))
+	if err := copyFile(vmf, dst); err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
+
+// collectLogs moves the .log files the tools wrote next to the VMF into logs/.
+func (w workspace) collectLogs() {
+	logs, _ := filepath.Glob(filepath.Join(w.work(), "*.log"))
+	for _, l := range logs {
+		_ = os.Rename(l, filepath.Join(w.logs(), filepath.Base(l)))
+	}
+}
+
+func (w workspace) remove() {
+	if w.root == "" {
+		return
+	}
+
+	if err := os.RemoveAll(w.root); err != nil {
+		logger.Warn("Failed to remove job workspace", zap.String("path", w.root), zap.Error(err))
+	}
+}
+
+// finishWorkspace applies the cleanup policy once j reached a terminal state. Kept workspaces
+// are stamped with the finish time so pruneWorkspaces can expire them.
+func (j *job) finishWorkspace(state string) {
+	if j.ws.root == "" {
+		return
+	}
+
+	j.ws.collectLogs()
+
+	// A job cancelled while queued has nothing worth keeping.
+	j.mu.Lock()
+	ran := !j.rec.Started.IsZero()
+	j.mu.Unlock()
+
+	policy := j.cfg.workspaceCleanup()
+	if !ran || policy == cleanupAlways || (policy == cleanupOnSuccess && state == jobSucceeded) {
+		j.ws.remove()
+		return
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(j.ws.root, now, now)
+
+	j.mu.Lock()
+	j.rec.Workspace = j.ws.root
+	j.mu.Unlock()
+	j.send("info", "Kept workspace "+j.ws.root)
+}
+
+// pruneWorkspaces removes kept workspaces older than workspaceRetention and, after the same
+// time, any left over from jobs that were still running when the server stopped. Only
+// directories named like a job ID and holding the workspace marker are considered.
+func pruneWorkspaces() {
+	c := currentConfig()
+	retention := c.workspaceRetention()
+	if retention == 0 {
+		return
+	}
+
+	root := c.workspaceRoot()
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-retention)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !e.IsDir() || info.ModTime().After(cutoff) || !isJobID(e.Name()) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(root, e.Name(), workspaceMarker)); err != nil {
+			continue
+		}
+		if j, ok := jobs.get(e.Name()); ok && !isTerminal(j.status()) {
+			continue
+		}
+
+		workspace{root: filepath.Join(root, e.Name())}.remove()
+		logger.Info("Removed expired workspace", zap.String("job", e.Name()))
+	}
+}
+
+// workspaceRoot returns the directory job workspaces are created in. The older tmp setting is
+// still honoured when workspaceRoot isn't set.
+func (c Config) workspaceRoot() string {
+	switch {
+	case c.WorkspaceRoot != "":
+		return c.WorkspaceRoot
+	case c.TmpDir != "":
+		return filepath.Join(c.TmpDir, "maprelay-workspaces")
+	}
+
+	return filepath.Join(c.dataDir(), "workspaces")
+}
+
+func (c Config) workspaceCleanup() string {
+	switch c.WorkspaceCleanup {
+	case "":
+		return cleanupOnSuccess
+	case cleanupAlways, cleanupOnSuccess, cleanupNever:
+		return c.WorkspaceCleanup
+	}
+
+	logger.Warn("Invalid workspaceCleanup, using default", zap.String("value", c.WorkspaceCleanup))
+	return cleanupOnSuccess
+}
+
+// workspaceRetention returns how long kept workspaces stay, or 0 for no limit.
+func (c Config) workspaceRetention() time.Duration {
+	return durationSetting("workspaceRetention", c.WorkspaceRetention, defaultWorkspaceRetention)
+}
+
+// publishBSP copies a compiled BSP into the configured bspdir. The copy is renamed into place
+// so concurrent jobs compiling the same map never leave a partial file there; the last one to
+// finish wins.
+func publishBSP(dir, src, id string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	dst := filepath.Join(dir, filepath.Base(src))
+	part := dst + "." + id + ".part"
+	err := copyFile(src, part)
+	if err == nil {
+		err = os.Rename(part, dst)
+	}
+	if err != nil {
+		_ = os.Remove(part)
+		return "", err
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package server
+
+import "syscall"
+
+// accessWrite and accessExec are W_OK and X_OK from access(2).
+const (
+	accessWrite = 0x2
+	accessExec  = 0x1
+)
+
+// dirWritable reports whether files can be created in dir, without creating any.
+func dirWritable(dir string) error {
+	return syscall.Access(dir, accessWrite|accessExec)
+}